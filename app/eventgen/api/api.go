@@ -18,7 +18,8 @@ package api
 import (
 	"google/jss/pubsub-integration/eventgen/config"
 	"google/jss/pubsub-integration/eventgen/generator"
-	"log"
+	"google/jss/pubsub-integration/logging"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -34,7 +35,7 @@ func response(c *gin.Context, code int, body interface{}) {
 }
 
 func responseError(c *gin.Context, statusCode int, err error) {
-	log.Printf("encounter server error: %v", err)
+	slog.Error("encounter server error", "err", err)
 	response(c, statusCode, "")
 }
 
@@ -45,17 +46,18 @@ type GeneratorReq struct {
 }
 
 func random(c *gin.Context) {
-	log.Printf("start to generate event")
+	slog.Info("start to generate event")
+	threads, runtime := config.GeneratorDefaults()
 	req := GeneratorReq{
-		Threads: config.Config.Threads,
-		Runtime: config.Config.Timeout.Minutes(),
+		Threads: threads,
+		Runtime: runtime.Minutes(),
 	}
 	if err := c.Bind(&req); err != nil {
-		log.Printf("bad request parameters, err: %v", err)
+		slog.Warn("bad request parameters", "err", err)
 		response(c, http.StatusBadRequest, nil)
 		return
 	}
-	log.Printf("request parameters: %+v", req)
+	slog.Info("request parameters", "threads", req.Threads, "runtime", req.Runtime)
 	timeout := time.Duration(req.Runtime * float64(time.Minute))
 	if err := generator.Start(generator.NewEvent, req.Threads, timeout); err != nil {
 		responseError(c, http.StatusBadRequest, err)
@@ -68,7 +70,7 @@ func shutdown(c *gin.Context) {
 
 // StartRESTServer starts the REST server
 func StartRESTServer() {
-	log.Printf("start REST server")
+	slog.Info("start REST server")
 
 	router := gin.Default()
 	msgRouter := router.Group("/api/msg")
@@ -81,6 +83,6 @@ func StartRESTServer() {
 		Handler: router,
 	}
 	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+		logging.Fatal("fail to start REST server", "err", err)
 	}
 }
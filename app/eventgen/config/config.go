@@ -16,58 +16,114 @@
 package config
 
 import (
+	"context"
 	"google/jss/pubsub-integration/avro"
-	"google/jss/pubsub-integration/env"
-	"log"
+	"google/jss/pubsub-integration/loader"
+	"google/jss/pubsub-integration/logging"
+	"google/jss/pubsub-integration/pubsub"
+	"log/slog"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/linkedin/goavro/v2"
 )
 
 type config struct {
-	Node                    string
-	RESTPort                string
-	Location                string
-	EventTopic              string
-	EventCodec              *goavro.Codec // codec is thread safe
-	PublisherBatchSize      int
-	PublisherNumGoroutines  int
-	PublisherMaxOutstanding int
-	PublisherRetryInit      time.Duration
-	PublisherRetryTotal     time.Duration
-	Threads                 int
-	Timeout                 time.Duration
+	Node                         string
+	RESTPort                     string        `env:"REST_PORT" default:"8001" validate:"required"`
+	Location                     string        `env:"GOOGLE_CLOUD_LOCATION" default:"west" validate:"required"`
+	EventTopic                   string        `env:"EVENT_TOPIC" default:"EventTopic" validate:"required"`
+	EventAvsc                    string        `env:"EVENT_AVSC" default:"Event.avsc" validate:"required"`
+	EventCodec                   *goavro.Codec // codec is thread safe
+	PublisherBatchSize           int           `env:"PUBLISHER_BATCH_SIZE" default:"100" validate:"min=0"`
+	PublisherNumGoroutines       int           `env:"PUBLISHER_THREADS" default:"0" validate:"min=0"`                                                            // use default 25 * GOMAXPROCS
+	PublisherMaxOutstanding      int           `env:"PUBLISHER_FLOW_CONTROL_MAX_OUTSTANDING_MESSAGES" default:"100" validate:"min=-1"`                           // -1 for no limit
+	PublisherBatchBytes          int           `env:"PUBLISHER_BATCH_BYTES" default:"0" validate:"min=0"`                                                        // use default 1e6
+	PublisherBatchDelay          time.Duration `env:"PUBLISHER_BATCH_DELAY" default:"0" unit:"s" validate:"min=0"`                                               // use default 10ms
+	PublisherBufferedByteLimit   int           `env:"PUBLISHER_BUFFERED_BYTE_LIMIT" default:"0" validate:"min=0"`                                                // use default 10 * MaxPublishRequestBytes
+	PublisherMaxOutstandingBytes int           `env:"PUBLISHER_FLOW_CONTROL_MAX_OUTSTANDING_BYTES" default:"0" validate:"min=-1"`                                // use default no limit
+	PublisherLimitExceeded       string        `env:"PUBLISHER_FLOW_CONTROL_LIMIT_EXCEEDED_BEHAVIOR" default:"block" validate:"oneof=block ignore signal-error"` // the behavior when the flow control limits are exceeded
+	PublisherTimeout             time.Duration `env:"PUBLISHER_TIMEOUT" default:"0" unit:"s" validate:"min=0"`                                                   // the timeout of publishing a batch, use default 60s
+	PublisherRetryInit           time.Duration `env:"PUBLISHER_RETRY_INITIAL_TIMEOUT" default:"5" unit:"s" validate:"min=0"`
+	PublisherRetryTotal          time.Duration `env:"PUBLISHER_RETRY_TOTAL_TIMEOUT" default:"600" unit:"s" validate:"min=0"`
+	Threads                      int           `env:"EVENT_GENERATOR_THREADS" default:"200" validate:"min=0" reload:"live"` // use GeneratorDefaults to read it
+	Timeout                      time.Duration `env:"EVENT_GENERATOR_RUNTIME" default:"5" unit:"m" validate:"min=0" reload:"live"`
 }
 
-// Config is the global configuration parsed from environment variables.
+// WatchInterval is the interval to check whether the config file is modified
+const WatchInterval = 10 * time.Second
+
+// mux protects the fields can be reloaded live
+var mux sync.RWMutex
+
+// Config is the global configuration parsed from defaults, config file, environment variables and flags.
 var Config config
 
 func init() {
-	log.SetOutput(os.Stdout)
-
 	hostName, err := os.Hostname()
 	if err != nil {
-		log.Fatalf("fail to get hostname, err: %v", err)
+		logging.Fatal("fail to get hostname", "err", err)
 	}
-	eventCodec, err := avro.NewCodedecFromFile(env.GetEnv("EVENT_AVSC", "Event.avsc"))
+	result, err := loader.Load(&Config)
 	if err != nil {
-		log.Fatalf("fail to create event avro codec, err: %v", err)
+		logging.Fatal("invalid config", "err", err)
+	}
+	// The config of the other packages, e.g. logging and tracing, has been loaded before this package
+	if err := loader.CheckFlags(); err != nil {
+		logging.Fatal("invalid config", "err", err)
+	}
+	Config.Node = hostName
+	if err := PublishSettings().Validate(); err != nil {
+		logging.Fatal("invalid publish settings", "err", err)
+	}
+
+	Config.EventCodec, err = avro.NewCodedecFromFile(Config.EventAvsc)
+	if err != nil {
+		logging.Fatal("fail to create event avro codec", "err", err)
+	}
+	slog.Info("using config", "config", result)
+}
+
+// PublishSettings returns the settings of publishing the events
+func PublishSettings() pubsub.PublishSettings {
+	return pubsub.PublishSettings{
+		CountThreshold:         Config.PublisherBatchSize,
+		ByteThreshold:          Config.PublisherBatchBytes,
+		DelayThreshold:         Config.PublisherBatchDelay,
+		NumGoroutines:          Config.PublisherNumGoroutines,
+		Timeout:                Config.PublisherTimeout,
+		BufferedByteLimit:      Config.PublisherBufferedByteLimit,
+		MaxOutstandingMessages: Config.PublisherMaxOutstanding,
+		MaxOutstandingBytes:    Config.PublisherMaxOutstandingBytes,
+		LimitExceededBehavior:  Config.PublisherLimitExceeded,
 	}
+}
+
+// GeneratorDefaults returns the default threads and runtime of the generator, they can be reloaded live
+func GeneratorDefaults() (int, time.Duration) {
+	mux.RLock()
+	defer mux.RUnlock()
+	return Config.Threads, Config.Timeout
+}
 
-	Config = config{
-		Node:                    hostName,
-		RESTPort:                env.GetEnv("REST_PORT", "8001"),
-		Location:                env.GetEnv("GOOGLE_CLOUD_LOCATION", "west"),
-		EventTopic:              env.GetEnv("EVENT_TOPIC", "EventTopic"),
-		EventCodec:              eventCodec,
-		PublisherBatchSize:      env.GetEnvInt("PUBLISHER_BATCH_SIZE", 100),
-		PublisherNumGoroutines:  env.GetEnvInt("PUBLISHER_THREADS", 0), // use default 25 * GOMAXPROCS
-		PublisherMaxOutstanding: env.GetEnvInt("PUBLISHER_FLOW_CONTROL_MAX_OUTSTANDING_MESSAGES", 100),
-		PublisherRetryInit:      time.Duration(env.GetEnvFloat64("PUBLISHER_RETRY_INITIAL_TIMEOUT", 5) * float64(time.Second)),
-		PublisherRetryTotal:     time.Duration(env.GetEnvFloat64("PUBLISHER_RETRY_TOTAL_TIMEOUT", 600) * float64(time.Second)),
-		Threads:                 env.GetEnvInt("EVENT_GENERATOR_THREADS", 200),
-		Timeout:                 time.Duration(env.GetEnvFloat64("EVENT_GENERATOR_RUNTIME", 5) * float64(time.Minute)),
+// Watch reloads the config on SIGHUP or config file modification until the context is done
+func Watch(ctx context.Context) {
+	loader.New().Watch(ctx, WatchInterval, func() {
+		reload()
+		logging.Reload()
+	})
+}
+
+func reload() {
+	mux.Lock()
+	defer mux.Unlock()
+	changes, err := loader.New().Reload(&Config)
+	if err != nil {
+		slog.Warn("fail to reload config, keep using the current config", "err", err)
+		return
+	}
+	for _, change := range changes {
+		slog.Info("reload config", "change", change.String())
 	}
-	log.Printf("using config: %+v", Config)
 }
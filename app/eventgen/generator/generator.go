@@ -18,10 +18,14 @@ package generator
 import (
 	"context"
 	"errors"
+	"fmt"
 	"google/jss/pubsub-integration/eventgen/config"
 	"google/jss/pubsub-integration/eventgen/generator/publishers"
+	"google/jss/pubsub-integration/logging"
 	"google/jss/pubsub-integration/pubsub"
-	"log"
+	"google/jss/pubsub-integration/tracing"
+	"log/slog"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -36,25 +40,34 @@ type generator struct {
 }
 
 // Initializes the Cloud Pub/Sub client and the topic for event generator
-func newGenerator(topicID string, codec *goavro.Codec, batchSize int, numGoroutines int, maxOutstanding int) (*generator, error) {
+func newGenerator(topicID string, codec *goavro.Codec, settings pubsub.PublishSettings) (*generator, error) {
 	var g generator
 
 	backoff := pubsub.NewClientBackoffConfig(config.Config.PublisherRetryInit, config.Config.PublisherRetryTotal)
 	client, err := pubsub.Service.NewClient(context.Background(), backoff)
 	if err != nil {
-		log.Printf("fail to connect to Cloud Pub/Sub, err: %v", err)
+		slog.Error("fail to connect to Cloud Pub/Sub", "err", err)
 		return nil, err
 	}
 	g.client = client
 
-	g.topic = client.NewTopic(topicID, codec, batchSize, numGoroutines, maxOutstanding)
+	if pubsub.UsingEmulator() {
+		if err := client.CreateTopicIfNotExists(context.Background(), topicID); err != nil {
+			slog.Error("fail to create topic on Cloud Pub/Sub emulator", "err", err)
+			client.Close() // nolint: errcheck
+			return nil, err
+		}
+	}
+	g.topic = client.NewTopic(topicID, codec, settings)
 	return &g, nil
 }
 
 // Creates the publisher group and starts to publish events
 func (g *generator) Run(event publishers.NewMessage, numPublishers int, timeout time.Duration) {
-	log.Printf("run event generator with numPublishers: %v, timeout: %v", numPublishers, timeout)
-	ctx, cancel := context.WithCancel(context.Background())
+	// The logs of the run are attached with the run ID carried by ctx
+	logger := slog.With(logging.RunID, fmt.Sprintf("%016x", rand.Uint64()))
+	logger.Info("run event generator", "publishers", numPublishers, "timeout", timeout)
+	ctx, cancel := context.WithCancel(logging.NewContext(context.Background(), logger))
 	g.cancel = cancel
 
 	pbrs := publishers.NewPublishers(g.topic, event, timeout)
@@ -78,11 +91,12 @@ func (g *generator) Stop() {
 	}
 }
 
-// Stops the topic and then close the Cloud Pub/Sub client
+// Stops the topic, exports the spans of the run and then close the Cloud Pub/Sub client
 func (g *generator) release() {
 	g.topic.Stop()
+	tracing.Flush()
 	if err := g.client.Close(); err != nil {
-		log.Printf("fail to close Cloud Pub/Sub client, err: %v", err)
+		slog.Warn("fail to close Cloud Pub/Sub client", "err", err)
 	}
 	mux.Lock()
 	defer mux.Unlock()
@@ -102,7 +116,7 @@ func Start(event publishers.NewMessage, numPublishers int, timeout time.Duration
 	if running != nil {
 		return errors.New("there is already an running generator")
 	}
-	g, err := newGenerator(config.Config.EventTopic, config.Config.EventCodec, config.Config.PublisherBatchSize, config.Config.PublisherNumGoroutines, config.Config.PublisherMaxOutstanding)
+	g, err := newGenerator(config.Config.EventTopic, config.Config.EventCodec, config.PublishSettings())
 	if err != nil {
 		return err
 	}
@@ -111,13 +125,20 @@ func Start(event publishers.NewMessage, numPublishers int, timeout time.Duration
 	return nil
 }
 
+// IsRunning reports whether there is a running generator
+func IsRunning() bool {
+	mux.Lock()
+	defer mux.Unlock()
+	return running != nil
+}
+
 // Stops the event generation
 func Stop() {
 	mux.Lock()
 	defer mux.Unlock()
 
 	if running == nil {
-		log.Printf("there is no running generator")
+		slog.Info("there is no running generator")
 		return
 	}
 	running.Stop()
@@ -0,0 +1,82 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package generator creates event message and publish to event topic
+package generator
+
+import (
+	"errors"
+	"google/jss/pubsub-integration/eventgen/config"
+	"google/jss/pubsub-integration/pubsub"
+	"google/jss/pubsub-integration/pubsub/pubsubtest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func useFakeService(t *testing.T) *pubsubtest.Service {
+	fake := pubsubtest.NewService()
+	pubsub.Service = fake
+	t.Cleanup(func() {
+		Stop()
+		fake.Close() // nolint: errcheck
+	})
+	return fake
+}
+
+// The generator publishes events until timeout and then releases itself
+func TestGeneratorTimeout(t *testing.T) {
+	fake := useFakeService(t)
+
+	err := Start(NewEvent, 2, 200*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, IsRunning())
+
+	// Only one generator can be running at a time
+	err = Start(NewEvent, 1, time.Minute)
+	assert.NotNil(t, err)
+
+	assert.Eventually(t, func() bool { return !IsRunning() }, 5*time.Second, 10*time.Millisecond)
+	events := fake.Published(config.Config.EventTopic)
+	assert.NotEmpty(t, events)
+	for _, event := range events {
+		assert.Equal(t, config.Config.Location, event["location"])
+	}
+}
+
+// The generator can be stopped before timeout, and a new one can be started after that
+func TestGeneratorStop(t *testing.T) {
+	fake := useFakeService(t)
+
+	err := Start(NewEvent, 1, time.Hour)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(fake.Published(config.Config.EventTopic)) > 0 }, 5*time.Second, 10*time.Millisecond)
+
+	Stop()
+	assert.False(t, IsRunning())
+	err = Start(NewEvent, 1, time.Hour)
+	assert.Nil(t, err)
+}
+
+// Publish errors do not stop the publishers
+func TestGeneratorPublishError(t *testing.T) {
+	fake := useFakeService(t)
+	fake.FailPublish(config.Config.EventTopic, errors.New("publish error"), errors.New("publish error"))
+	fake.SetPublishLatency(config.Config.EventTopic, 10*time.Millisecond)
+
+	err := Start(NewEvent, 1, time.Hour)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(fake.Published(config.Config.EventTopic)) >= 3 }, 5*time.Second, 10*time.Millisecond)
+}
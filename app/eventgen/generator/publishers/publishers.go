@@ -17,8 +17,9 @@ package publishers
 
 import (
 	"context"
+	"google/jss/pubsub-integration/logging"
 	"google/jss/pubsub-integration/pubsub"
-	"log"
+	"google/jss/pubsub-integration/tracing"
 	"strconv"
 	"sync"
 	"time"
@@ -35,6 +36,7 @@ type Publishers struct {
 	timeout    time.Duration
 	sync.Locker
 	waitFinish *sync.Cond
+	sampler    logging.Sampler // samples the logs of published messages
 }
 
 // NewPublishers creates the publishers group for publishing message concurrently.
@@ -63,14 +65,14 @@ func (pbrs *Publishers) Add(ctx context.Context, number int) {
 			newLen = 0
 		}
 		stopPubs := pbrs.publishers[newLen:]
-		log.Printf("stopping %v publishers", len(stopPubs))
+		logging.FromContext(ctx).Info("stopping publishers", "number", len(stopPubs))
 		for _, p := range stopPubs {
 			p.Stop()
 		}
 		pbrs.publishers = pbrs.publishers[:newLen]
 	} else {
 		// Add publishers
-		log.Printf("starting %v publishers", number)
+		logging.FromContext(ctx).Info("starting publishers", "number", number)
 		for i := 0; i < number; i++ {
 			name := pbrs.Topic.GetID() + "-publisher-" + strconv.Itoa(len(pbrs.publishers))
 			pbrs.addOne(ctx, name)
@@ -147,18 +149,23 @@ func (pbr *publisher) run(ctx context.Context) {
 	// Create new thread to publish until pbrCtx done
 	go func() {
 		defer pbr.finish()
-		log.Printf("%v: started", pbr.name)
+		logger := logging.FromContext(ctx).With(logging.Publisher, pbr.name)
+		logger.Info("publisher started")
 		for {
 			select {
 			case <-pbrCtx.Done():
-				log.Printf("%v: context done, stopped", pbr.name)
+				logger.Info("context done, publisher stopped")
 				return
 			default:
 				msg := pbr.newMessage()
-				if id, err := pbr.Publish(ctx, msg); err != nil {
-					log.Printf("%v: err: %v", pbr.name, err)
+				msgLogger := pbr.sampler.Logger(logger)
+				msgCtx, span := tracing.Start(logging.NewContext(ctx, msgLogger), pbr.Topic.GetID()+" publish", tracing.Producer)
+				id, err := pbr.Publish(msgCtx, msg)
+				tracing.End(span, err)
+				if err != nil {
+					msgLogger.Warn("fail to publish message", "err", err)
 				} else {
-					log.Printf("%v: published message ID: %v", pbr.name, id)
+					msgLogger.Info("published message", logging.MessageID, id)
 				}
 			}
 		}
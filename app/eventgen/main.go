@@ -16,15 +16,28 @@
 package main
 
 import (
+	"context"
 	"google/jss/pubsub-integration/eventgen/api"
 	"google/jss/pubsub-integration/eventgen/config"
 	"google/jss/pubsub-integration/eventgen/generator"
-	"log"
+	"google/jss/pubsub-integration/logging"
+	"google/jss/pubsub-integration/tracing"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	if err := generator.Start(generator.NewEvent, config.Config.Threads, config.Config.Timeout); err != nil {
-		log.Fatalf("fail to start generator, err: %v", err)
+	// Stop the generator and export the buffered spans on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	defer tracing.Shutdown()
+	go config.Watch(ctx)
+
+	threads, timeout := config.GeneratorDefaults()
+	if err := generator.Start(generator.NewEvent, threads, timeout); err != nil {
+		logging.Fatal("fail to start generator", "err", err)
 	}
-	api.StartRESTServer()
+	go api.StartRESTServer()
+	<-ctx.Done()
+	generator.Stop()
 }
@@ -17,15 +17,21 @@ package main
 
 import (
 	"context"
+	"google/jss/pubsub-integration/logging"
 	"google/jss/pubsub-integration/metrics/ack/metrics"
 	"google/jss/pubsub-integration/metrics/processor"
-
-	"log"
+	_ "google/jss/pubsub-integration/metrics/stations" // registers the stations middleware
+	"google/jss/pubsub-integration/tracing"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	ctx := context.Background()
+	// Stop receiving and close the metrics sinks on SIGINT or SIGTERM, so that the written metrics are complete
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	defer tracing.Shutdown()
 	if err := processor.Start(ctx, metrics.New); err != nil {
-		log.Fatalf("fail to start metircs ack, err: %v", err)
+		logging.Fatal("fail to start metircs ack", "err", err)
 	}
 }
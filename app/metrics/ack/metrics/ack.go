@@ -22,6 +22,6 @@ import (
 
 // New creates ack metrics from given event message, It is just the same with the metrics.New().
 // Redeclared here for clarity and test purpose.
-func New(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration) (map[string]interface{}, error) {
-	return metrics.New(event, publishTime, ackTime, processingTime)
+func New(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+	return metrics.New(event, publishTime, ackTime, processingTime, deliveryAttempt)
 }
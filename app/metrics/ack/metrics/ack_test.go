@@ -32,7 +32,7 @@ func TestMetricsAck(t *testing.T) {
 	publishTime := time.Now()
 	processingTime := processor.ProcessingTime()
 	ackTime := publishTime.Add(processingTime)
-	m, err := New(event, publishTime, ackTime, processingTime)
+	m, err := New(event, publishTime, ackTime, processingTime, 0)
 	assert.Nil(t, err)
 
 	// valiate event_timestamp
@@ -58,12 +58,19 @@ func TestMetricsAckAvroCodec(t *testing.T) {
 	publishTime := time.Now()
 	processingTime := processor.ProcessingTime()
 	ackTime := publishTime.Add(processingTime)
-	m, err := New(event, publishTime, ackTime, processingTime)
+	m, err := New(event, publishTime, ackTime, processingTime, 2)
 	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"int": int32(2)}, m["delivery_attempt"])
 
 	json, err := avro.EncodeToJSON(config.Config.MetricsCodec, m)
 	assert.Nil(t, err)
 	native, err := avro.DecodeFromJSON(config.Config.MetricsCodec, json)
 	assert.Nil(t, err)
+	// The station metadata is not joined, so it is decoded with the default null of the schema
+	for _, field := range []string{"station_name", "station_operator", "connector_type", "max_power_kw", "latitude", "longitude", "station_known"} {
+		assert.Contains(t, native, field)
+		assert.Nil(t, native[field])
+		m[field] = nil
+	}
 	assert.Equal(t, m, native)
 }
@@ -0,0 +1,70 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main is the entry point of MetricsAggregate.
+package main
+
+import (
+	"context"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/logging"
+	"google/jss/pubsub-integration/metrics/aggregate/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/metrics/processor"
+	_ "google/jss/pubsub-integration/metrics/stations" // registers the stations middleware
+	"google/jss/pubsub-integration/pubsub"
+	"google/jss/pubsub-integration/tracing"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	// The open windows are published on SIGINT or SIGTERM, since their events have been acked
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	defer tracing.Shutdown()
+	// The redelivered events would be counted twice in their windows, e.g. the ack is lost or expired
+	if config.Config.DedupeStore == "off" {
+		logging.Fatal("the aggregate metrics requires DEDUPE_STORE, so that the redelivered events are not counted twice")
+	}
+	windows, err := metrics.ParseWindows(config.Config.AggregateWindows)
+	if err != nil {
+		logging.Fatal("invalid aggregate windows", "err", err)
+	}
+	codec, err := avro.NewCodedecFromFile(config.Config.AggregateAvsc)
+	if err != nil {
+		logging.Fatal("fail to create aggregate avro codec", "err", err)
+	}
+	client, err := pubsub.Service.NewClient(ctx, nil)
+	if err != nil {
+		logging.Fatal("fail to create client", "err", err)
+	}
+	defer client.Close() // nolint: errcheck
+	if pubsub.UsingEmulator() {
+		if err := client.CreateTopicIfNotExists(ctx, config.Config.AggregateTopic); err != nil {
+			logging.Fatal("fail to create aggregate topic", "err", err)
+		}
+	}
+
+	// The window results are published to the aggregate topic, no metrics is written to METRICS_SINKS
+	topic := client.NewTopic(config.Config.AggregateTopic, codec, config.PublishSettings())
+	defer topic.Stop()
+	aggregator := metrics.NewAggregator(windows, config.Config.AggregateLateness)
+	err = aggregator.Process(ctx, topic, config.Config.AggregateFlushInterval, func(ctx context.Context) error {
+		return processor.StartConsumer(ctx, aggregator.New)
+	})
+	if err != nil {
+		logging.Fatal("fail to start metircs aggregate", "err", err)
+	}
+}
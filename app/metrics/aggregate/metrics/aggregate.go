@@ -0,0 +1,321 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics aggregates the metrics of events in tumbling and sliding windows per location and station.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"google/jss/pubsub-integration/avro"
+	complete "google/jss/pubsub-integration/metrics/complete/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/pubsub"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Window is the tumbling window if Slide equals Size, or the sliding window starts every Slide
+type Window struct {
+	Size  time.Duration
+	Slide time.Duration
+}
+
+// ParseWindows parses the comma separated list of size for tumbling window or size/slide for sliding window in seconds
+func ParseWindows(s string) ([]Window, error) {
+	var windows []Window
+	for _, w := range strings.Split(s, ",") {
+		sizeSec, slideSec, sliding := strings.Cut(strings.TrimSpace(w), "/")
+		if !sliding {
+			slideSec = sizeSec
+		}
+		size, err := strconv.Atoi(sizeSec)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid window size: %v", w)
+		}
+		slide, err := strconv.Atoi(slideSec)
+		if err != nil || slide <= 0 || slide > size {
+			return nil, fmt.Errorf("invalid window slide: %v", w)
+		}
+		windows = append(windows, Window{Size: time.Duration(size) * time.Second, Slide: time.Duration(slide) * time.Second})
+	}
+	return windows, nil
+}
+
+// starts returns the start times of the windows containing the given event time, they are aligned to Unix epoch
+func (w Window) starts(eventTime time.Time) []time.Time {
+	var starts []time.Time
+	for start := eventTime.Truncate(w.Slide); start.Add(w.Size).After(eventTime); start = start.Add(-w.Slide) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+type windowKey struct {
+	window    Window
+	start     time.Time
+	location  string
+	stationID int32
+}
+
+// aggregate is the accumulated metrics of a window
+type aggregate struct {
+	count           int64
+	totalKWh        float64
+	totalChargeRate float64
+	processingTimes []float64 // in seconds
+	lags            []float64 // from the session end to the ack in seconds
+}
+
+// Aggregator accumulates the metrics of events in windows, and closes the windows when the watermark passes their end.
+// The watermark is the latest event time minus the allowed lateness, and it moves on with the wall clock if no newer event comes.
+type Aggregator struct {
+	windows  []Window
+	lateness time.Duration
+
+	mux      sync.Mutex
+	open     map[windowKey]*aggregate
+	latest   time.Time // the latest event time
+	observed time.Time // the wall clock when the latest event time is observed
+
+	late    atomic.Int64             // the number of late events, which are too late for all their windows
+	dropped atomic.Int64             // the number of window results failed to publish after the retries on shutdown
+	pending []map[string]interface{} // the window results failed to publish, they are published again by the next flush of Run
+}
+
+// NewAggregator creates the aggregator of the given windows
+func NewAggregator(windows []Window, lateness time.Duration) *Aggregator {
+	return &Aggregator{
+		windows:  windows,
+		lateness: lateness,
+		open:     map[windowKey]*aggregate{},
+	}
+}
+
+// New is the metrics factory adding the event to its windows, it returns nil metrics since the window results are published by Run
+func (a *Aggregator) New(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+	metrics, err := complete.New(event, publishTime, ackTime, processingTime, deliveryAttempt)
+	if err != nil {
+		return nil, err
+	}
+	location, err := avro.GetValue(metrics, "location", "")
+	if err != nil {
+		return nil, err
+	}
+	stationID, err := avro.GetValue(metrics, "station_id", int32(0))
+	if err != nil {
+		return nil, err
+	}
+	eventTime, err := avro.GetValue(metrics, "event_timestamp", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	chargeRate, err := avro.GetValue(metrics, "avg_charge_rate_kw", float32(0))
+	if err != nil {
+		return nil, err
+	}
+	kWh, err := avro.GetFloatTypeValue(metrics, "charged_total_kwh")
+	if err != nil {
+		return nil, err
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	now := time.Now()
+	if eventTime.After(a.latest) {
+		a.latest, a.observed = eventTime, now
+	}
+	watermark := a.watermark(now)
+	var added bool
+	for _, w := range a.windows {
+		for _, start := range w.starts(eventTime) {
+			if !start.Add(w.Size).After(watermark) {
+				continue // the window is closed
+			}
+			key := windowKey{window: w, start: start, location: location, stationID: stationID}
+			agg, ok := a.open[key]
+			if !ok {
+				agg = &aggregate{}
+				a.open[key] = agg
+			}
+			agg.count++
+			agg.totalKWh += float64(kWh)
+			agg.totalChargeRate += float64(chargeRate)
+			agg.processingTimes = append(agg.processingTimes, processingTime.Seconds())
+			agg.lags = append(agg.lags, ackTime.Sub(eventTime).Seconds())
+			added = true
+		}
+	}
+	if !added {
+		slog.Warn("late event is dropped", "session_id", metrics["session_id"], "event_time", eventTime, "watermark", watermark)
+		a.late.Add(1)
+	}
+	return nil, nil
+}
+
+// watermark returns the event time before which the windows are closed, it must be called with the lock held
+func (a *Aggregator) watermark(now time.Time) time.Time {
+	if a.latest.IsZero() {
+		return time.Time{}
+	}
+	return a.latest.Add(now.Sub(a.observed)).Add(-a.lateness)
+}
+
+// Late returns the number of late events dropped
+func (a *Aggregator) Late() int64 {
+	return a.late.Load()
+}
+
+// Dropped returns the number of window results dropped since they can not be published before shutdown
+func (a *Aggregator) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Flush closes the windows ended before the watermark, or all the windows if all is true, and returns their results ordered by window end
+func (a *Aggregator) Flush(now time.Time, all bool) []map[string]interface{} {
+	a.mux.Lock()
+	watermark := a.watermark(now)
+	closed := map[windowKey]*aggregate{}
+	for key, agg := range a.open {
+		if all || !key.start.Add(key.window.Size).After(watermark) {
+			closed[key] = agg
+			delete(a.open, key)
+		}
+	}
+	a.mux.Unlock()
+
+	keys := make([]windowKey, 0, len(closed))
+	for key := range closed {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ei, ej := keys[i].start.Add(keys[i].window.Size), keys[j].start.Add(keys[j].window.Size)
+		if !ei.Equal(ej) {
+			return ei.Before(ej)
+		}
+		if keys[i].location != keys[j].location {
+			return keys[i].location < keys[j].location
+		}
+		return keys[i].stationID < keys[j].stationID
+	})
+	results := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, closed[key].result(key))
+	}
+	return results
+}
+
+// result creates the window result in the schema of AGGREGATE_AVSC
+func (agg *aggregate) result(key windowKey) map[string]interface{} {
+	var totalLag float64
+	for _, lag := range agg.lags {
+		totalLag += lag
+	}
+	return map[string]interface{}{
+		"window_start":            key.start.UTC(),
+		"window_end":              key.start.Add(key.window.Size).UTC(),
+		"window_size_sec":         int32(key.window.Size.Seconds()),
+		"window_slide_sec":        int32(key.window.Slide.Seconds()),
+		"location":                key.location,
+		"station_id":              key.stationID,
+		"session_count":           agg.count,
+		"total_kwh":               float32(agg.totalKWh),
+		"mean_charge_rate_kw":     float32(agg.totalChargeRate / float64(agg.count)),
+		"p95_processing_time_sec": float32(percentile(agg.processingTimes, 0.95)),
+		"mean_lag_sec":            float32(totalLag / float64(agg.count)),
+		"p95_lag_sec":             float32(percentile(agg.lags, 0.95)),
+		"metrics_node":            config.Config.Node,
+	}
+}
+
+// percentile returns the nearest-rank percentile of the values, the values are sorted in place
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(p*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return values[rank]
+}
+
+// Run publishes the closed windows to the topic every interval until the context is done, and then publishes all the open windows.
+// The events of the windows have been acked, so the window results failed to publish are kept and published again with the next closed windows.
+// On shutdown they are retried with backoff by METRICS_PUBLISH_RETRIES, and dropped if they still can not be published.
+func (a *Aggregator) Run(ctx context.Context, topic pubsub.Topic, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			a.publish(context.Background(), topic, a.Flush(time.Now(), true))
+			a.retry(topic)
+			return
+		case <-ticker.C:
+			a.publish(ctx, topic, a.Flush(time.Now(), false))
+		}
+	}
+}
+
+// Process runs the processor, and publishes the window results to the topic while it is running.
+// The open windows are published after the processor returns, so that the acked events in them are not lost on shutdown.
+func (a *Aggregator) Process(ctx context.Context, topic pubsub.Topic, interval time.Duration, process func(context.Context) error) error {
+	runCtx, stop := context.WithCancel(context.Background())
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		a.Run(runCtx, topic, interval)
+	}()
+	err := process(ctx)
+	stop()
+	<-flushed
+	return err
+}
+
+// publish publishes the pending window results and then the given ones, the failed ones become pending
+func (a *Aggregator) publish(ctx context.Context, topic pubsub.Topic, results []map[string]interface{}) {
+	results = append(a.pending, results...)
+	a.pending = nil
+	for _, result := range results {
+		if _, err := topic.Publish(ctx, result); err != nil {
+			slog.Error("fail to publish window result, it will be retried", "window_end", result["window_end"], "location", result["location"], "station_id", result["station_id"], "err", err)
+			a.pending = append(a.pending, result)
+		}
+	}
+	if published := len(results) - len(a.pending); published > 0 {
+		slog.Info("window results are published", "windows", published, "pending_windows", len(a.pending), "late_events", a.Late())
+	}
+}
+
+// retry publishes the pending window results with backoff on shutdown, the ones still failed are dropped
+func (a *Aggregator) retry(topic pubsub.Topic) {
+	backoff := pubsub.NewBackoff(config.Config.MetricsPublishRetryInit, config.Config.MetricsPublishRetryMax)
+	for i := 0; i < config.Config.MetricsPublishRetries && len(a.pending) > 0; i++ {
+		time.Sleep(backoff.Pause())
+		a.publish(context.Background(), topic, nil)
+	}
+	if len(a.pending) > 0 {
+		slog.Error("fail to publish window results before shutdown, they are dropped", "windows", len(a.pending))
+		a.dropped.Add(int64(len(a.pending)))
+		a.pending = nil
+	}
+}
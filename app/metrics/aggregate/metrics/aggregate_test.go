@@ -0,0 +1,200 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/eventgen/generator"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/pubsub"
+	"google/jss/pubsub-integration/pubsub/pubsubtest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWindows(t *testing.T) {
+	windows, err := ParseWindows("60, 300/60")
+	assert.Nil(t, err)
+	assert.Equal(t, []Window{{Size: time.Minute, Slide: time.Minute}, {Size: 5 * time.Minute, Slide: time.Minute}}, windows)
+
+	for _, invalid := range []string{"", "0", "x", "60/0", "60/120", "60/x"} {
+		_, err := ParseWindows(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+// The event is in one tumbling window, and in size/slide sliding windows
+func TestWindowStarts(t *testing.T) {
+	eventTime := time.Date(2023, 1, 1, 0, 2, 30, 0, time.UTC)
+	assert.Equal(t, []time.Time{eventTime.Truncate(time.Minute)}, Window{Size: time.Minute, Slide: time.Minute}.starts(eventTime))
+
+	starts := Window{Size: 3 * time.Minute, Slide: time.Minute}.starts(eventTime)
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 1, 1, 0, 2, 0, 0, time.UTC),
+		time.Date(2023, 1, 1, 0, 1, 0, 0, time.UTC),
+		time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+	}, starts)
+}
+
+func newEvent(stationID int32, eventTime time.Time) map[string]interface{} {
+	event := generator.NewEvent()
+	event["station_id"] = stationID
+	event["session_end_time"] = eventTime
+	event["session_start_time"] = eventTime.Add(-time.Hour)
+	return event
+}
+
+// The windows are aggregated per station, and closed when the watermark passes their end
+func TestAggregator(t *testing.T) {
+	a := NewAggregator([]Window{{Size: time.Minute, Slide: time.Minute}}, 30*time.Second)
+	eventTime := time.Now().Truncate(time.Minute).Add(10 * time.Second)
+	for i, stationID := range []int32{1, 1, 2} {
+		processingTime := time.Duration(i+1) * 100 * time.Millisecond
+		m, err := a.New(newEvent(stationID, eventTime), eventTime, eventTime.Add(time.Second), processingTime, 0)
+		assert.Nil(t, err)
+		assert.Nil(t, m) // the metrics is published by the aggregator
+	}
+
+	// The watermark is behind the window end
+	assert.Empty(t, a.Flush(time.Now(), false))
+
+	results := a.Flush(time.Now().Add(2*time.Minute), false)
+	assert.Len(t, results, 2)
+	assert.Equal(t, int32(1), results[0]["station_id"])
+	assert.Equal(t, int64(2), results[0]["session_count"])
+	assert.Equal(t, float32(0.2), results[0]["p95_processing_time_sec"])
+	assert.Equal(t, float32(1), results[0]["mean_lag_sec"])
+	assert.Equal(t, eventTime.Truncate(time.Minute).UTC(), results[0]["window_start"])
+	assert.Equal(t, int32(2), results[1]["station_id"])
+	assert.Equal(t, int64(1), results[1]["session_count"])
+	assert.Empty(t, a.Flush(time.Now().Add(2*time.Minute), true))
+
+	// The event before the watermark is late for its window
+	_, err := a.New(newEvent(1, eventTime.Add(-time.Hour)), eventTime, eventTime, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), a.Late())
+	assert.Empty(t, a.Flush(time.Now(), true))
+}
+
+func TestPercentile(t *testing.T) {
+	assert.Equal(t, float64(0), percentile(nil, 0.95))
+	values := make([]float64, 100)
+	for i := range values {
+		values[i] = float64(100 - i)
+	}
+	assert.Equal(t, float64(95), percentile(values, 0.95))
+}
+
+// aggregateCodec loads the schema of AGGREGATE_AVSC, or the one in the repository if AGGREGATE_AVSC is not set
+func aggregateCodec(t *testing.T) *goavro.Codec {
+	path := config.Config.AggregateAvsc
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Join("..", "..", "..", "..", "infra", "config", "avro", "MetricsAggregate.avsc")
+	}
+	codec, err := avro.NewCodedecFromFile(path)
+	if err != nil {
+		t.Fatalf("fail to load the aggregate schema, err: %v", err)
+	}
+	return codec
+}
+
+// The window result is valid JSON matching the schema of AGGREGATE_AVSC
+func TestAggregatorAvroCodec(t *testing.T) {
+	codec := aggregateCodec(t)
+
+	a := NewAggregator([]Window{{Size: time.Minute, Slide: time.Minute}}, 0)
+	_, err := a.New(newEvent(1, time.Now()), time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	results := a.Flush(time.Now(), true)
+	assert.Len(t, results, 1)
+
+	json, err := avro.EncodeToJSON(codec, results[0])
+	assert.Nil(t, err)
+	native, err := avro.DecodeFromJSON(codec, json)
+	assert.Nil(t, err)
+	assert.Equal(t, results[0], native)
+}
+
+// The open windows are published after the processor returns on shutdown, including the events handled while stopping
+func TestAggregatorProcessFlush(t *testing.T) {
+	fake := pubsubtest.NewService()
+	t.Cleanup(func() { fake.Close() }) // nolint: errcheck
+	client, err := fake.NewClient(context.Background(), nil)
+	assert.Nil(t, err)
+	defer client.Close() // nolint: errcheck
+	topic := client.NewTopic(config.Config.AggregateTopic, aggregateCodec(t), pubsub.PublishSettings{CountThreshold: 1})
+	defer topic.Stop()
+
+	a := NewAggregator([]Window{{Size: time.Hour, Slide: time.Hour}}, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// The shutdown signal
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	err = a.Process(ctx, topic, time.Hour, func(ctx context.Context) error {
+		_, err := a.New(newEvent(1, time.Now()), time.Now(), time.Now(), 0, 0)
+		assert.Nil(t, err)
+		<-ctx.Done()
+		// The in-flight event is handled after the signal
+		_, err = a.New(newEvent(1, time.Now()), time.Now(), time.Now(), 0, 0)
+		return err
+	})
+	assert.Nil(t, err)
+
+	published := fake.Published(config.Config.AggregateTopic)
+	assert.Len(t, published, 1)
+	assert.Equal(t, int64(2), published[0]["session_count"])
+}
+
+// The window result failed to publish is published again, and dropped if it still fails after the retries on shutdown
+func TestAggregatorPublishRetry(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.MetricsPublishRetries = 2
+	config.Config.MetricsPublishRetryInit = time.Millisecond
+	config.Config.MetricsPublishRetryMax = time.Millisecond
+
+	for failures, dropped := range map[int]int64{2: 0, 3: 1} {
+		fake := pubsubtest.NewService()
+		t.Cleanup(func() { fake.Close() }) // nolint: errcheck
+		client, err := fake.NewClient(context.Background(), nil)
+		assert.Nil(t, err)
+		defer client.Close() // nolint: errcheck
+		topic := client.NewTopic(config.Config.AggregateTopic, aggregateCodec(t), pubsub.PublishSettings{CountThreshold: 1})
+		defer topic.Stop()
+		for i := 0; i < failures; i++ {
+			fake.FailPublish(config.Config.AggregateTopic, errors.New("publish error"))
+		}
+
+		a := NewAggregator([]Window{{Size: time.Hour, Slide: time.Hour}}, time.Hour)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = a.Process(ctx, topic, time.Hour, func(ctx context.Context) error {
+			_, err := a.New(newEvent(1, time.Now()), time.Now(), time.Now(), 0, 0)
+			return err
+		})
+		assert.Nil(t, err)
+		assert.Len(t, fake.Published(config.Config.AggregateTopic), 1-int(dropped), failures)
+		assert.Equal(t, dropped, a.Dropped(), failures)
+	}
+}
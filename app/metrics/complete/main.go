@@ -17,14 +17,23 @@ package main
 
 import (
 	"context"
+	"google/jss/pubsub-integration/logging"
 	"google/jss/pubsub-integration/metrics/complete/metrics"
 	"google/jss/pubsub-integration/metrics/processor"
-	"log"
+	_ "google/jss/pubsub-integration/metrics/stations" // registers the stations middleware
+	"google/jss/pubsub-integration/tracing"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	ctx := context.Background()
-	if err := processor.Start(ctx, metrics.New); err != nil {
-		log.Fatalf("fail to start metircs complete, err: %v", err)
+	// Stop receiving and close the metrics sinks on SIGINT or SIGTERM, so that the written metrics are complete
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	defer tracing.Shutdown()
+	completer := metrics.NewCompleter()
+	processor.RegisterStat(processor.ClampedLevel, completer.Clamped)
+	if err := processor.Start(ctx, completer.New); err != nil {
+		logging.Fatal("fail to start metircs complete", "err", err)
 	}
 }
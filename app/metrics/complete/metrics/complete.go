@@ -17,41 +17,78 @@ package metrics
 
 import (
 	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/logging"
 	"google/jss/pubsub-integration/metrics"
+	"log/slog"
+	"sync/atomic"
 	"time"
 )
 
-// New generate complete metrics
-func New(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration) (map[string]interface{}, error) {
-	metrics, err := metrics.New(event, publishTime, ackTime, processingTime)
+// Completer generates complete metrics and counts the metrics whose battery_level_end is clamped at 1,
+// the overcharge quality rule rejects such events instead
+type Completer struct {
+	clamped atomic.Int64
+	sampler logging.Sampler // samples the logs of the clamped metrics, since most of the generated events charge more than the remaining capacity
+}
+
+// NewCompleter creates the complete metrics factory
+func NewCompleter() *Completer {
+	return &Completer{}
+}
+
+// Clamped returns the number of metrics whose battery_level_end is clamped at 1
+func (c *Completer) Clamped() int64 {
+	return c.clamped.Load()
+}
+
+// New generate complete metrics, the clamped battery level is counted and logged
+func (c *Completer) New(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+	metrics, levelEnd, err := complete(event, publishTime, ackTime, processingTime, deliveryAttempt)
 	if err != nil {
 		return nil, err
 	}
+	if levelEnd > 1.0 {
+		c.clamped.Add(1)
+		c.sampler.Logger(slog.Default()).Info("battery level end is clamped at 1", "session_id", metrics["session_id"], "battery_level_end", levelEnd)
+	}
+	return metrics, nil
+}
+
+// New generate complete metrics, the clamped battery level is neither counted nor logged, see Completer
+func New(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+	metrics, _, err := complete(event, publishTime, ackTime, processingTime, deliveryAttempt)
+	return metrics, err
+}
+
+// complete generates complete metrics, it returns the battery_level_end before clamping as well
+func complete(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, float32, error) {
+	metrics, err := metrics.New(event, publishTime, ackTime, processingTime, deliveryAttempt)
+	if err != nil {
+		return nil, 0, err
+	}
 	var float32Zero float32
 	levelStart, err := avro.GetValue(metrics, "battery_level_start", float32Zero)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	chargeRate, err := avro.GetValue(metrics, "avg_charge_rate_kw", float32Zero)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	duration, err := avro.GetValue(metrics, "session_duration_hr", float32Zero)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	capacity, err := avro.GetValue(metrics, "battery_capacity_kwh", float32Zero)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	levelEnd := levelStart + (chargeRate * duration / capacity)
-	if levelEnd > 1.0 {
-		levelEnd = 1.0
-	}
-	metrics["battery_level_end"] = floatValue(levelEnd)
-	metrics["charged_total_kwh"] = floatValue((levelEnd - levelStart) * capacity)
+	clampedEnd := min(levelEnd, 1.0)
+	metrics["battery_level_end"] = floatValue(clampedEnd)
+	metrics["charged_total_kwh"] = floatValue((clampedEnd - levelStart) * capacity)
 
-	return metrics, nil
+	return metrics, levelEnd, nil
 }
 
 func floatValue(value float32) map[string]interface{} {
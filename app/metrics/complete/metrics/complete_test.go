@@ -32,7 +32,7 @@ func TestMetricsComplete(t *testing.T) {
 	publishTime := time.Now()
 	processingTime := processor.ProcessingTime()
 	ackTime := publishTime.Add(processingTime)
-	m, err := New(event, publishTime, ackTime, processingTime)
+	m, err := New(event, publishTime, ackTime, processingTime, 0)
 	assert.Nil(t, err)
 
 	// valiate event_timestamp
@@ -80,12 +80,40 @@ func TestMetricsAckAvroCodec(t *testing.T) {
 	publishTime := time.Now()
 	processingTime := processor.ProcessingTime()
 	ackTime := publishTime.Add(processingTime)
-	m, err := New(event, publishTime, ackTime, processingTime)
+	m, err := New(event, publishTime, ackTime, processingTime, 0)
 	assert.Nil(t, err)
 
 	json, err := avro.EncodeToJSON(config.Config.MetricsCodec, m)
 	assert.Nil(t, err)
 	native, err := avro.DecodeFromJSON(config.Config.MetricsCodec, json)
 	assert.Nil(t, err)
+	// The station metadata is not joined, so it is decoded with the default null of the schema
+	for _, field := range []string{"station_name", "station_operator", "connector_type", "max_power_kw", "latitude", "longitude", "station_known"} {
+		assert.Contains(t, native, field)
+		assert.Nil(t, native[field])
+		m[field] = nil
+	}
 	assert.Equal(t, m, native)
 }
+
+// The battery level end is clamped at 1 and counted if the charged energy exceeds the remaining capacity
+func TestMetricsCompleteClamped(t *testing.T) {
+	event := generator.NewEvent()
+	event["session_start_time"] = event["session_end_time"].(time.Time).Add(-time.Hour)
+	event["avg_charge_rate_kw"] = float32(100)
+	event["battery_capacity_kwh"] = float32(50)
+	event["battery_level_start"] = float32(0.5)
+	c := NewCompleter()
+
+	m, err := c.New(event, time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"float": float32(1)}, m["battery_level_end"])
+	assert.Equal(t, map[string]interface{}{"float": float32(25)}, m["charged_total_kwh"])
+	assert.Equal(t, int64(1), c.Clamped())
+
+	// The metrics within the remaining capacity is not counted
+	event["avg_charge_rate_kw"] = float32(10)
+	_, err = c.New(event, time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), c.Clamped())
+}
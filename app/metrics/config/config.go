@@ -16,56 +16,314 @@
 package config
 
 import (
+	"context"
+	"fmt"
 	"google/jss/pubsub-integration/avro"
-	"google/jss/pubsub-integration/env"
-	"log"
+	"google/jss/pubsub-integration/loader"
+	"google/jss/pubsub-integration/logging"
+	"google/jss/pubsub-integration/pubsub"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/linkedin/goavro/v2"
 )
 
+// eventConfig is the event subscription and the schemas of the events
+type eventConfig struct {
+	EventAvsc            string `env:"EVENT_AVSC" default:"Event.avsc" validate:"required"`
+	EventCodec           *goavro.Codec
+	EventSchemaRevisions string                   `env:"EVENT_SCHEMA_REVISIONS"` // comma separated list of revisionID=path
+	EventRevisions       map[string]*goavro.Codec // the codecs of event schema revisions keyed by revision ID
+	EventSubscription    string                   `env:"EVENT_SUBSCRIPTION" default:"EventSubscription" validate:"required"`
+	EventTopic           string                   `env:"EVENT_TOPIC" default:"EventTopic"`                                      // only used to create the event subscription on the Cloud Pub/Sub emulator
+	ErrorTopic           string                   `env:"ERROR_TOPIC" default:"ErrorTopic"`                                      // the dead letter topic of the event subscription
+	DeadLetterPublish    bool                     `env:"DEAD_LETTER_PUBLISH"`                                                   // publish the failed events to the error topic with the failure reason instead of nacking them
+	DecodeErrorTopic     string                   `env:"DECODE_ERROR_TOPIC"`                                                    // the topic without schema of the undecodable events, empty to nack them
+	MaxDeliveryAttempts  int                      `env:"SUBSCRIBER_MAX_DELIVERY_ATTEMPTS" default:"5" validate:"min=5,max=100"` // only used to create the event subscription on the Cloud Pub/Sub emulator
+}
+
+// subscriberConfig is how the events are received by pull or push
+type subscriberConfig struct {
+	SubscriptionMode              string        `env:"SUBSCRIPTION_MODE" default:"pull" validate:"oneof=pull push"`                      // pull the events by streaming pull, or serve the push subscription by HTTP
+	PushPort                      int           `env:"PORT" default:"8080" validate:"min=1,max=65535"`                                   // the port of the push endpoint, PORT is set by Cloud Run
+	PushPath                      string        `env:"PUSH_PATH" default:"/push"`                                                        // the path of the push endpoint
+	PushUnwrapped                 bool          `env:"PUSH_UNWRAPPED"`                                                                   // the push subscription enables payload unwrapping with metadata
+	PushAudience                  string        `env:"PUSH_AUDIENCE"`                                                                    // the audience of the OIDC token, empty to skip the token verification
+	PushServiceAccount            string        `env:"PUSH_SERVICE_ACCOUNT"`                                                             // the service account the OIDC token must be issued to, empty to accept any
+	PushAckDeadline               time.Duration `env:"PUSH_ACK_DEADLINE" default:"10" unit:"s" validate:"min=10,max=600"`                // the ack deadline of the push subscription, the pushed event is redelivered after it
+	SubscriberNumGoroutines       int           `env:"SUBSCRIBER_THREADS" default:"0" validate:"min=0"`                                  // use default 10
+	SubscriberMaxOutstanding      int           `env:"SUBSCRIBER_FLOW_CONTROL_MAX_OUTSTANDING_MESSAGES" default:"100" validate:"min=-1"` // -1 for no limit
+	SubscriberMaxOutstandingBytes int           `env:"SUBSCRIBER_FLOW_CONTROL_MAX_OUTSTANDING_BYTES" default:"0" validate:"min=-1"`      // use default 1e9, -1 for no limit
+	SubscriberMaxExtension        time.Duration `env:"SUBSCRIBER_MAX_EXTENSION" default:"0" unit:"s"`                                    // use default 60 minutes, negative to disable the extension
+	SubscriberMaxExtensionPeriod  time.Duration `env:"SUBSCRIBER_MAX_EXTENSION_PERIOD" default:"0" unit:"s" validate:"min=0"`            // between 10 and 600 seconds, 0 to use the ack latency
+	SubscriberMinExtensionPeriod  time.Duration `env:"SUBSCRIBER_MIN_EXTENSION_PERIOD" default:"0" unit:"s" validate:"min=0"`            // between 10 and 600 seconds, 0 to use the ack latency
+	SubscriberSynchronous         bool          `env:"SUBSCRIBER_SYNCHRONOUS"`                                                           // the event subscription must not enable exactly-once delivery
+	SubscriberRetryInit           time.Duration `env:"SUBSCRIBER_RETRY_INITIAL_BACKOFF" default:"1" unit:"s" validate:"min=0"`
+	SubscriberRetryMax            time.Duration `env:"SUBSCRIBER_RETRY_MAX_BACKOFF" default:"60" unit:"s" validate:"min=0"`
+}
+
+// publisherConfig is how the metrics are published
+type publisherConfig struct {
+	PublisherBatchSize           int           `env:"PUBLISHER_BATCH_SIZE" default:"100" validate:"min=0"`
+	PublisherNumGoroutines       int           `env:"PUBLISHER_THREADS" default:"0" validate:"min=0"`                                                            // use default 25 * GOMAXPROCS
+	PublisherMaxOutstanding      int           `env:"PUBLISHER_FLOW_CONTROL_MAX_OUTSTANDING_MESSAGES" default:"0" validate:"min=-1"`                             // use default 1000, -1 for no limit
+	PublisherBatchBytes          int           `env:"PUBLISHER_BATCH_BYTES" default:"0" validate:"min=0"`                                                        // use default 1e6
+	PublisherBatchDelay          time.Duration `env:"PUBLISHER_BATCH_DELAY" default:"0" unit:"s" validate:"min=0"`                                               // use default 10ms
+	PublisherBufferedByteLimit   int           `env:"PUBLISHER_BUFFERED_BYTE_LIMIT" default:"0" validate:"min=0"`                                                // use default 10 * MaxPublishRequestBytes
+	PublisherMaxOutstandingBytes int           `env:"PUBLISHER_FLOW_CONTROL_MAX_OUTSTANDING_BYTES" default:"0" validate:"min=-1"`                                // use default no limit
+	PublisherLimitExceeded       string        `env:"PUBLISHER_FLOW_CONTROL_LIMIT_EXCEEDED_BEHAVIOR" default:"block" validate:"oneof=block ignore signal-error"` // the behavior when the flow control limits are exceeded
+	PublisherTimeout             time.Duration `env:"PUBLISHER_TIMEOUT" default:"0" unit:"s" validate:"min=0"`                                                   // the timeout of publishing a batch, use default 60s
+	MetricsPublishFailurePolicy  string        `env:"METRICS_PUBLISH_FAILURE_POLICY" default:"nack" validate:"oneof=nack retry best-effort"`                     // nack, retry and then nack, or ack anyway in best-effort mode
+	MetricsPublishRetries        int           `env:"METRICS_PUBLISH_RETRIES" default:"3" validate:"min=0"`
+	MetricsPublishRetryInit      time.Duration `env:"METRICS_PUBLISH_RETRY_INITIAL_BACKOFF" default:"0.1" unit:"s" validate:"min=0"`
+	MetricsPublishRetryMax       time.Duration `env:"METRICS_PUBLISH_RETRY_MAX_BACKOFF" default:"2" unit:"s" validate:"min=0"`
+}
+
+// sinkConfig is the destinations of the metrics
+type sinkConfig struct {
+	MetricsTopic              string `env:"METRICS_TOPIC" default:"MetricsTopic" validate:"required"`
+	MetricsAvsc               string `env:"METRICS_AVSC" default:"MetricsAck.avsc" validate:"required"`
+	MetricsCodec              *goavro.Codec
+	MetricsSinks              string        `env:"METRICS_SINKS" default:"pubsub"`                                        // comma separated list of pubsub, stdout, ocf, csv or parquet
+	MetricsFileDir            string        `env:"METRICS_FILE_DIR" default:"metrics"`                                    // the directory of the ocf, csv and parquet files
+	MetricsFileRotateInterval time.Duration `env:"METRICS_FILE_ROTATE_INTERVAL" default:"3600" unit:"s" validate:"min=0"` // a new file is opened after it, 0 to disable
+	MetricsFileRotateRecords  int           `env:"METRICS_FILE_ROTATE_RECORDS" default:"100000" validate:"min=0"`         // a new file is opened after the number of metrics, 0 to disable
+	MetricsFileBlockRecords   int           `env:"METRICS_FILE_BLOCK_RECORDS" default:"10000" validate:"min=1"`           // the metrics buffered per ocf block or parquet row group
+}
+
+// middlewareConfig is the middlewares wrapping the metrics factory
+type middlewareConfig struct {
+	MetricsMiddlewares string  `env:"METRICS_MIDDLEWARES"`                             // comma separated list of middlewares in order, e.g. validate,filter,sample
+	FilterLocations    string  `env:"FILTER_LOCATIONS"`                                // comma separated list of locations kept by the filter middleware, empty to keep all
+	SampleRatio        float64 `env:"SAMPLE_RATIO" default:"1" validate:"min=0,max=1"` // the ratio of events kept by the sample middleware
+	StationCatalog     string  `env:"STATION_CATALOG"`                                 // the CSV or JSON file of the station metadata joined by the stations middleware
+	QuarantineTopic    string  `env:"QUARANTINE_TOPIC"`                                // the topic of the invalid events, empty to handle them as the other failures
+}
+
+// qualityConfig is the rules of the quality middleware
+type qualityConfig struct {
+	QualityRules               string        `env:"QUALITY_RULES" default:"session_order,battery_level,charge_rate,battery_capacity,session_duration"` // comma separated list of the rules checked by the quality middleware
+	QualityMaxChargeRate       float64       `env:"QUALITY_MAX_CHARGE_RATE" default:"350" validate:"min=0"`                                            // in kW
+	QualityMinBatteryCapacity  float64       `env:"QUALITY_MIN_BATTERY_CAPACITY" default:"10" validate:"min=0"`                                        // in kWh
+	QualityMaxBatteryCapacity  float64       `env:"QUALITY_MAX_BATTERY_CAPACITY" default:"200" validate:"min=0"`                                       // in kWh
+	QualityMaxSessionDuration  time.Duration `env:"QUALITY_MAX_SESSION_DURATION" default:"86400" unit:"s" validate:"min=0"`
+	QualityOverchargeTolerance float64       `env:"QUALITY_OVERCHARGE_TOLERANCE" default:"0.1" validate:"min=0"` // the ratio of the charged energy allowed to exceed the remaining battery capacity
+}
+
+// dedupeConfig is the store of the processed session IDs to skip the duplicate events
+type dedupeConfig struct {
+	DedupeStore     string        `env:"DEDUPE_STORE" default:"off" validate:"oneof=off memory bolt"`
+	DedupeRetention time.Duration `env:"DEDUPE_RETENTION" default:"3600" unit:"s" validate:"min=0"` // the session IDs older than it are forgotten
+	DedupeCacheSize int           `env:"DEDUPE_CACHE_SIZE" default:"100000" validate:"min=1"`       // the max session IDs in the memory store
+	DedupePath      string        `env:"DEDUPE_PATH" default:"dedupe.db"`                           // the file of the bolt store
+}
+
+// aggregateConfig is only used by the aggregate metrics
+type aggregateConfig struct {
+	AggregateTopic         string        `env:"AGGREGATE_TOPIC" default:"AggregateTopic"` // the topic of the window results
+	AggregateAvsc          string        `env:"AGGREGATE_AVSC" default:"MetricsAggregate.avsc"`
+	AggregateWindows       string        `env:"AGGREGATE_WINDOWS" default:"60,300/60"`                             // comma separated list of size for tumbling window or size/slide for sliding window in seconds
+	AggregateLateness      time.Duration `env:"AGGREGATE_ALLOWED_LATENESS" default:"30" unit:"s" validate:"min=0"` // the events behind the latest event time by more than it are late
+	AggregateFlushInterval time.Duration `env:"AGGREGATE_FLUSH_INTERVAL" default:"1" unit:"s" validate:"required"` // the interval to publish the closed windows
+}
+
+// processingConfig is the timeout and the simulated processing time of the events
+type processingConfig struct {
+	ProcessingTimeout       time.Duration `env:"PROCESSING_TIMEOUT" default:"0" unit:"s" validate:"min=0"`                                                     // 0 to only bound the processing by the lease deadline
+	ProcessingTimeoutPolicy string        `env:"PROCESSING_TIMEOUT_POLICY" default:"nack" validate:"oneof=nack dead-letter"`                                   // nack the timed out event, or publish it to the error topic
+	StatsInterval           time.Duration `env:"STATS_INTERVAL" default:"60" unit:"s" validate:"min=0"`                                                        // the interval to log the processor stats, 0 to disable
+	ProcessingTimeModel     string        `env:"PROCESSING_TIME_MODEL" default:"normal" validate:"oneof=fixed uniform normal lognormal bimodal" reload:"live"` // use GetProcessingTime to read the processing time settings
+	ProcessingTimeFixed     time.Duration `env:"PROCESSING_TIME_FIXED" default:"0.2" unit:"s" validate:"min=0" reload:"live"`                                  // the processing time of the fixed model
+	ProcessingTimeMin       time.Duration `env:"PROCESSING_TIME_MIN" default:"0.1" unit:"s" validate:"min=0" reload:"live"`
+	ProcessingTimeMax       time.Duration `env:"PROCESSING_TIME_MAX" default:"0.3" unit:"s" validate:"min=0" reload:"live"`
+	ProcessingTimeLimit     time.Duration `env:"PROCESSING_TIME_LIMIT" default:"5" unit:"s" validate:"min=0" reload:"live"`
+	ProcessingTimeSigma     float64       `env:"PROCESSING_TIME_SIGMA" default:"1" validate:"min=0" reload:"live"`
+	ProcessingTimeSlowMin   time.Duration `env:"PROCESSING_TIME_SLOW_MIN" default:"1" unit:"s" validate:"min=0" reload:"live"`
+	ProcessingTimeSlowMax   time.Duration `env:"PROCESSING_TIME_SLOW_MAX" default:"3" unit:"s" validate:"min=0" reload:"live"`
+	ProcessingTimeSlowRatio float64       `env:"PROCESSING_TIME_SLOW_RATIO" default:"0.1" validate:"min=0,max=1" reload:"live"`
+}
+
+// nackConfig is only used by the nack metrics, use GetNackSettings to read it
+type nackConfig struct {
+	NackRatio    float64 `env:"NACK_RATIO" default:"1" validate:"min=0,max=1" reload:"live"` // the ratio of events nacked
+	NackAttempts int     `env:"NACK_ATTEMPTS" validate:"min=0" reload:"live"`                // only the first delivery attempts are nacked, 0 to nack every attempt
+}
+
 type config struct {
-	Node                     string
-	EventCodec               *goavro.Codec
-	EventSubscription        string
-	MetricsTopic             string
-	MetricsCodec             *goavro.Codec
-	SubscriberNumGoroutines  int
-	SubscriberMaxOutstanding int
-	PublisherBatchSize       int
-	PublisherNumGoroutines   int
-}
-
-// Config is the global configuration parsed from environment variables.
+	Node string
+	eventConfig
+	subscriberConfig
+	publisherConfig
+	sinkConfig
+	middlewareConfig
+	qualityConfig
+	dedupeConfig
+	aggregateConfig
+	processingConfig
+	nackConfig
+}
+
+// WatchInterval is the interval to check whether the config file is modified
+const WatchInterval = 10 * time.Second
+
+// mux protects the fields can be reloaded live
+var mux sync.RWMutex
+
+// Config is the global configuration parsed from defaults, config file, environment variables and flags.
 var Config config
 
 func init() {
-	log.SetOutput(os.Stdout)
-
 	hostName, err := os.Hostname()
 	if err != nil {
-		log.Fatalf("fail to get hostname, err: %v", err)
+		logging.Fatal("fail to get hostname", "err", err)
+	}
+	result, err := loader.Load(&Config)
+	if err != nil {
+		logging.Fatal("invalid config", "err", err)
+	}
+	// The config of the other packages, e.g. logging and tracing, has been loaded before this package
+	if err := loader.CheckFlags(); err != nil {
+		logging.Fatal("invalid config", "err", err)
+	}
+	Config.Node = hostName
+	if err := ReceiveSettings().Validate(); err != nil {
+		logging.Fatal("invalid receive settings", "err", err)
+	}
+	if err := PublishSettings().Validate(); err != nil {
+		logging.Fatal("invalid publish settings", "err", err)
+	}
+	if Config.SubscriberMaxExtension > 0 && Config.SubscriberMaxExtension < Config.ProcessingTimeLimit {
+		slog.Warn("the events processed longer than the max extension will be redelivered", "max_extension", Config.SubscriberMaxExtension, "processing_time_limit", Config.ProcessingTimeLimit)
 	}
 
-	eventCodec, err := avro.NewCodedecFromFile(env.GetEnv("EVENT_AVSC", "Event.avsc"))
+	Config.EventCodec, err = avro.NewCodedecFromFile(Config.EventAvsc)
+	if err != nil {
+		logging.Fatal("fail to create event avro codec", "err", err)
+	}
+	Config.EventRevisions, err = newRevisionCodecs(Config.EventSchemaRevisions)
+	if err != nil {
+		logging.Fatal("fail to create event schema revision codecs", "err", err)
+	}
+	Config.MetricsCodec, err = avro.NewCodedecFromFile(Config.MetricsAvsc)
 	if err != nil {
-		log.Fatalf("fail to create event avro codec, err: %v", err)
+		logging.Fatal("fail to create metrics avro codec", "err", err)
+	}
+	slog.Info("using config", "config", result)
+}
+
+// ReceiveSettings returns the settings of receiving the events from the event subscription
+func ReceiveSettings() pubsub.ReceiveSettings {
+	return pubsub.ReceiveSettings{
+		NumGoroutines:          Config.SubscriberNumGoroutines,
+		MaxOutstandingMessages: Config.SubscriberMaxOutstanding,
+		MaxOutstandingBytes:    Config.SubscriberMaxOutstandingBytes,
+		MaxExtension:           Config.SubscriberMaxExtension,
+		MaxExtensionPeriod:     Config.SubscriberMaxExtensionPeriod,
+		MinExtensionPeriod:     Config.SubscriberMinExtensionPeriod,
+		Synchronous:            Config.SubscriberSynchronous,
+	}
+}
+
+// PublishSettings returns the settings of publishing the metrics, it is also used by the error and quarantine topics
+func PublishSettings() pubsub.PublishSettings {
+	return pubsub.PublishSettings{
+		CountThreshold:         Config.PublisherBatchSize,
+		ByteThreshold:          Config.PublisherBatchBytes,
+		DelayThreshold:         Config.PublisherBatchDelay,
+		NumGoroutines:          Config.PublisherNumGoroutines,
+		Timeout:                Config.PublisherTimeout,
+		BufferedByteLimit:      Config.PublisherBufferedByteLimit,
+		MaxOutstandingMessages: Config.PublisherMaxOutstanding,
+		MaxOutstandingBytes:    Config.PublisherMaxOutstandingBytes,
+		LimitExceededBehavior:  Config.PublisherLimitExceeded,
+	}
+}
+
+// ProcessingTime is the settings of the simulated processing time
+type ProcessingTime struct {
+	Model     string        // fixed, uniform, normal, lognormal or bimodal
+	Fixed     time.Duration // the processing time of the fixed model
+	Min       time.Duration // the typical processing time is between Min and Max
+	Max       time.Duration
+	Limit     time.Duration // the upper limit of the processing time
+	Sigma     float64       // the shape of lognormal, the larger the heavier tail
+	SlowMin   time.Duration // the slow mode of bimodal is between SlowMin and SlowMax
+	SlowMax   time.Duration
+	SlowRatio float64 // the ratio of the slow mode of bimodal
+}
+
+// GetProcessingTime returns the settings of the simulated processing time, they can be reloaded live
+func GetProcessingTime() ProcessingTime {
+	mux.RLock()
+	defer mux.RUnlock()
+	return ProcessingTime{
+		Model:     Config.ProcessingTimeModel,
+		Fixed:     Config.ProcessingTimeFixed,
+		Min:       Config.ProcessingTimeMin,
+		Max:       Config.ProcessingTimeMax,
+		Limit:     Config.ProcessingTimeLimit,
+		Sigma:     Config.ProcessingTimeSigma,
+		SlowMin:   Config.ProcessingTimeSlowMin,
+		SlowMax:   Config.ProcessingTimeSlowMax,
+		SlowRatio: Config.ProcessingTimeSlowRatio,
 	}
-	metricsCodec, err := avro.NewCodedecFromFile(env.GetEnv("METRICS_AVSC", "MetricsAck.avsc"))
+}
+
+// GetNackSettings returns the ratio of events and the number of delivery attempts nacked by the nack metrics, they can be reloaded live
+func GetNackSettings() (float64, int) {
+	mux.RLock()
+	defer mux.RUnlock()
+	return Config.NackRatio, Config.NackAttempts
+}
+
+// Update changes the config holding the lock of the live fields, e.g. the tests set the live fields while the config may be reloaded
+func Update(update func()) {
+	mux.Lock()
+	defer mux.Unlock()
+	update()
+}
+
+// Watch reloads the config on SIGHUP or config file modification until the context is done
+func Watch(ctx context.Context) {
+	loader.New().Watch(ctx, WatchInterval, func() {
+		reload()
+		logging.Reload()
+	})
+}
+
+func reload() {
+	mux.Lock()
+	defer mux.Unlock()
+	changes, err := loader.New().Reload(&Config)
 	if err != nil {
-		log.Fatalf("fail to create metrics avro codec, err: %v", err)
+		slog.Warn("fail to reload config, keep using the current config", "err", err)
+		return
+	}
+	for _, change := range changes {
+		slog.Info("reload config", "change", change.String())
 	}
+}
 
-	Config = config{
-		Node:                     hostName,
-		EventSubscription:        env.GetEnv("EVENT_SUBSCRIPTION", "EventSubscription"),
-		EventCodec:               eventCodec,
-		MetricsTopic:             env.GetEnv("METRICS_TOPIC", "MetricsTopic"),
-		MetricsCodec:             metricsCodec,
-		SubscriberNumGoroutines:  env.GetEnvInt("SUBSCRIBER_THREADS", 0), // use default 10
-		SubscriberMaxOutstanding: env.GetEnvInt("SUBSCRIBER_FLOW_CONTROL_MAX_OUTSTANDING_MESSAGES", 100),
-		PublisherBatchSize:       env.GetEnvInt("PUBLISHER_BATCH_SIZE", 100),
-		PublisherNumGoroutines:   env.GetEnvInt("PUBLISHER_THREADS", 0), // use default 25 * GOMAXPROCS
+// newRevisionCodecs creates the codecs of schema revisions from the comma separated list of revisionID=path
+func newRevisionCodecs(revisions string) (map[string]*goavro.Codec, error) {
+	codecs := map[string]*goavro.Codec{}
+	for _, revision := range strings.Split(revisions, ",") {
+		revision = strings.TrimSpace(revision)
+		if revision == "" {
+			continue
+		}
+		id, path, found := strings.Cut(revision, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid schema revision %v, revisionID=path is expected", revision)
+		}
+		codec, err := avro.NewCodedecFromFile(path)
+		if err != nil {
+			return nil, err
+		}
+		codecs[id] = codec
 	}
-	log.Printf("using config: %+v", Config)
+	return codecs, nil
 }
@@ -22,14 +22,19 @@ import (
 )
 
 // Factory is the interface for creating metrics from given event message
-type Factory func(map[string]interface{}, time.Time, time.Time, time.Duration) (map[string]interface{}, error)
+// The delivery attempt is 0 if the subscription does not have a dead letter policy.
+type Factory func(map[string]interface{}, time.Time, time.Time, time.Duration, int) (map[string]interface{}, error)
 
 // New creates metrics from given event message
-func New(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration) (map[string]interface{}, error) {
+func New(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
 	sessionEnd, err := avro.GetValue(event, "session_end_time", time.Time{})
 	if err != nil {
 		return nil, err
 	}
+	var attempt interface{}
+	if deliveryAttempt > 0 {
+		attempt = map[string]interface{}{"int": int32(deliveryAttempt)}
+	}
 	sessionStart, err := avro.GetValue(event, "session_start_time", time.Time{})
 	if err != nil {
 		return nil, err
@@ -50,5 +55,7 @@ func New(event map[string]interface{}, publishTime time.Time, ackTime time.Time,
 		"battery_level_start":  event["battery_level_start"],
 		"event_node":           event["event_node"],
 		"metrics_node":         config.Config.Node,
+		"delivery_attempt":     attempt,
+		// The optional station metadata is joined by the stations middleware, otherwise the default null of the schema is used
 	}, nil
 }
@@ -0,0 +1,185 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/metrics/config"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Middleware wraps the metrics factory to add a step before or after it
+type Middleware func(Factory) Factory
+
+// Chain wraps the factory with the middlewares, the event goes through the middlewares in order and then the factory
+func Chain(factory Factory, middlewares ...Middleware) Factory {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		factory = middlewares[i](factory)
+	}
+	return factory
+}
+
+// InvalidEventError is the error of the event violating the validation rule.
+// The invalid event is routed to the quarantine topic if it is set, since retrying does not help.
+type InvalidEventError struct {
+	Rule string
+	Err  error
+}
+
+func (e *InvalidEventError) Error() string {
+	return fmt.Sprintf("invalid event, rule: %v, err: %v", e.Rule, e.Err)
+}
+
+func (e *InvalidEventError) Unwrap() error {
+	return e.Err
+}
+
+// Validate fails the event with InvalidEventError of the given rule if check returns an error
+func Validate(rule string, check func(event map[string]interface{}) error) Middleware {
+	return func(next Factory) Factory {
+		return func(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+			if err := check(event); err != nil {
+				return nil, &InvalidEventError{Rule: rule, Err: err}
+			}
+			return next(event, publishTime, ackTime, processingTime, deliveryAttempt)
+		}
+	}
+}
+
+// Filter skips the event if keep returns false, the skipped event is acked without metrics
+func Filter(keep func(event map[string]interface{}) bool) Middleware {
+	return func(next Factory) Factory {
+		return func(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+			if !keep(event) {
+				return nil, nil
+			}
+			return next(event, publishTime, ackTime, processingTime, deliveryAttempt)
+		}
+	}
+}
+
+// Enrich changes the event before the factory, e.g. adds the fields looked up from other sources
+func Enrich(enrich func(event map[string]interface{}) error) Middleware {
+	return func(next Factory) Factory {
+		return func(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+			if err := enrich(event); err != nil {
+				return nil, fmt.Errorf("fail to enrich event, err: %w", err)
+			}
+			return next(event, publishTime, ackTime, processingTime, deliveryAttempt)
+		}
+	}
+}
+
+// Transform changes the metrics generated by the factory, the skipped event is not transformed
+func Transform(transform func(metrics map[string]interface{}) (map[string]interface{}, error)) Middleware {
+	return func(next Factory) Factory {
+		return func(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+			metrics, err := next(event, publishTime, ackTime, processingTime, deliveryAttempt)
+			if err != nil || metrics == nil {
+				return metrics, err
+			}
+			return transform(metrics)
+		}
+	}
+}
+
+// Sample keeps the given ratio of events randomly, the others are skipped
+func Sample(ratio float64) Middleware {
+	return Filter(func(map[string]interface{}) bool {
+		return rand.Float64() < ratio
+	})
+}
+
+// middlewares are the middlewares can be assembled from METRICS_MIDDLEWARES keyed by name.
+// The context is the lifetime of the processor, the background work of the middleware stops when it is done.
+var middlewares = map[string]func(context.Context) (Middleware, error){
+	"validate": func(context.Context) (Middleware, error) {
+		return Validate("required_fields", requiredFields), nil
+	},
+	"filter": func(context.Context) (Middleware, error) {
+		return Filter(inLocations(config.Config.FilterLocations)), nil
+	},
+	"sample": func(context.Context) (Middleware, error) {
+		return Sample(config.Config.SampleRatio), nil
+	},
+}
+
+// Register adds the middleware can be assembled from METRICS_MIDDLEWARES, it is called in init of the package providing the middleware
+func Register(name string, middleware func(context.Context) (Middleware, error)) {
+	middlewares[name] = middleware
+}
+
+// FromConfig wraps the factory with the middlewares given by METRICS_MIDDLEWARES, the middlewares stop their background work when the context is done
+func FromConfig(ctx context.Context, factory Factory) (Factory, error) {
+	if config.Config.MetricsMiddlewares == "" {
+		return factory, nil
+	}
+	var chain []Middleware
+	for _, name := range strings.Split(config.Config.MetricsMiddlewares, ",") {
+		name = strings.TrimSpace(name)
+		newMiddleware, ok := middlewares[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown metrics middleware: %v", name)
+		}
+		middleware, err := newMiddleware(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("fail to create metrics middleware: %v, err: %w", name, err)
+		}
+		chain = append(chain, middleware)
+	}
+	slog.Info("using metrics middlewares", "middlewares", config.Config.MetricsMiddlewares)
+	return Chain(factory, chain...), nil
+}
+
+// requiredFields checks the event has the fields used by the metrics factories
+func requiredFields(event map[string]interface{}) error {
+	if id, _ := event["session_id"].(string); id == "" {
+		return errors.New("session_id is empty")
+	}
+	if location, _ := event["location"].(string); location == "" {
+		return errors.New("location is empty")
+	}
+	for _, key := range []string{"session_start_time", "session_end_time"} {
+		if _, err := avro.GetValue(event, key, time.Time{}); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{"avg_charge_rate_kw", "battery_capacity_kwh", "battery_level_start"} {
+		if _, err := avro.GetValue(event, key, float32(0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inLocations keeps the events in the comma separated list of locations, or all events if it is empty
+func inLocations(locations string) func(map[string]interface{}) bool {
+	keep := map[string]bool{}
+	for _, location := range strings.Split(locations, ",") {
+		if location = strings.TrimSpace(location); location != "" {
+			keep[location] = true
+		}
+	}
+	return func(event map[string]interface{}) bool {
+		location, _ := event["location"].(string)
+		return len(keep) == 0 || keep[location]
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"google/jss/pubsub-integration/eventgen/generator"
+	"google/jss/pubsub-integration/metrics/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The event goes through the middlewares in order and then the factory
+func TestChain(t *testing.T) {
+	var steps []string
+	step := func(name string) Middleware {
+		return Enrich(func(event map[string]interface{}) error {
+			steps = append(steps, name)
+			return nil
+		})
+	}
+	factory := Chain(New, step("first"), step("second"), Transform(func(metrics map[string]interface{}) (map[string]interface{}, error) {
+		steps = append(steps, "transform")
+		metrics["location"] = "transformed"
+		return metrics, nil
+	}))
+	m, err := factory(generator.NewEvent(), time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first", "second", "transform"}, steps)
+	assert.Equal(t, "transformed", m["location"])
+}
+
+// The invalid event fails and the filtered event is skipped without metrics
+func TestValidateAndFilter(t *testing.T) {
+	factory := Chain(New, Validate("required_fields", requiredFields), Filter(inLocations("east, west")))
+	event := generator.NewEvent()
+	event["location"] = "west"
+	m, err := factory(event, time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, m)
+
+	event["location"] = "north"
+	m, err = factory(event, time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	delete(event, "session_end_time")
+	_, err = factory(event, time.Now(), time.Now(), 0, 0)
+	var invalid *InvalidEventError
+	assert.ErrorAs(t, err, &invalid)
+	assert.Equal(t, "required_fields", invalid.Rule)
+
+	// The failure of enrich fails the event
+	factory = Chain(New, Enrich(func(map[string]interface{}) error { return errors.New("enrich error") }))
+	_, err = factory(generator.NewEvent(), time.Now(), time.Now(), 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestSample(t *testing.T) {
+	for _, ratio := range []float64{0, 1} {
+		factory := Chain(New, Sample(ratio))
+		m, err := factory(generator.NewEvent(), time.Now(), time.Now(), 0, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, ratio == 1, m != nil)
+	}
+}
+
+// The middlewares are assembled from METRICS_MIDDLEWARES
+func TestFromConfig(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+
+	config.Config.MetricsMiddlewares = "validate, sample"
+	config.Config.SampleRatio = 0
+	factory, err := FromConfig(context.Background(), New)
+	assert.Nil(t, err)
+	m, err := factory(generator.NewEvent(), time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	config.Config.MetricsMiddlewares = "validate,unknown"
+	_, err = FromConfig(context.Background(), New)
+	assert.NotNil(t, err)
+
+	config.Config.MetricsMiddlewares = ""
+	factory, err = FromConfig(context.Background(), New)
+	assert.Nil(t, err)
+	m, err = factory(generator.NewEvent(), time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, m)
+}
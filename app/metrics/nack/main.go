@@ -17,20 +17,21 @@ package main
 
 import (
 	"context"
-	"errors"
+	"google/jss/pubsub-integration/logging"
+	"google/jss/pubsub-integration/metrics/nack/metrics"
 	"google/jss/pubsub-integration/metrics/processor"
-	"log"
-	"time"
+	_ "google/jss/pubsub-integration/metrics/stations" // registers the stations middleware
+	"google/jss/pubsub-integration/tracing"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	ctx := context.Background()
-	if err := processor.Start(ctx, newNackMetrics); err != nil {
-		log.Fatalf("fail to start metircs nack, err: %v", err)
+	// Stop receiving and close the metrics sinks on SIGINT or SIGTERM, so that the written metrics are complete
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	defer tracing.Shutdown()
+	if err := processor.Start(ctx, metrics.New); err != nil {
+		logging.Fatal("fail to start metircs nack", "err", err)
 	}
 }
-
-func newNackMetrics(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration) (map[string]interface{}, error) {
-	// simulate a bug 🐞 and nack the message
-	return nil, errors.New("simulate a bug 🐞 and nack the message")
-}
@@ -0,0 +1,36 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics fails to generate metrics from event, so that the event is nacked.
+package metrics
+
+import (
+	"errors"
+	"google/jss/pubsub-integration/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"math/rand"
+	"time"
+)
+
+// New fails to simulate a bug 🐞 and nack the message.
+// Only the ratio of events given by NACK_RATIO fails, the others are converted to ack metrics.
+// If NACK_ATTEMPTS is set, only the first NACK_ATTEMPTS delivery attempts fail, so that the event is redelivered and then succeeds.
+func New(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+	ratio, attempts := config.GetNackSettings()
+	if (attempts == 0 || deliveryAttempt <= attempts) && rand.Float64() < ratio {
+		// simulate a bug 🐞 and nack the message
+		return nil, errors.New("simulate a bug 🐞 and nack the message")
+	}
+	return metrics.New(event, publishTime, ackTime, processingTime, deliveryAttempt)
+}
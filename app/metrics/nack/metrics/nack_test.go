@@ -0,0 +1,48 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics fails to generate metrics
+package metrics
+
+import (
+	"google/jss/pubsub-integration/eventgen/generator"
+	"google/jss/pubsub-integration/metrics/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Every attempt fails by default
+func TestNack(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		_, err := New(generator.NewEvent(), time.Now(), time.Now(), 0, attempt)
+		assert.NotNil(t, err)
+	}
+}
+
+// Only the first NACK_ATTEMPTS attempts fail, the event succeeds on the next attempt
+func TestNackAttempts(t *testing.T) {
+	_, prev := config.GetNackSettings()
+	t.Cleanup(func() { config.Update(func() { config.Config.NackAttempts = prev }) })
+	config.Update(func() { config.Config.NackAttempts = 2 })
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		_, err := New(generator.NewEvent(), time.Now(), time.Now(), 0, attempt)
+		assert.NotNil(t, err)
+	}
+	m, err := New(generator.NewEvent(), time.Now(), time.Now(), 0, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"int": int32(3)}, m["delivery_attempt"])
+}
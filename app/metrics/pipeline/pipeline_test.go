@@ -0,0 +1,183 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pipeline tests the whole pipeline in process: event generator -> event topic -> metrics processor -> metrics or error topic.
+// Cloud Pub/Sub is replaced by the in-memory pubsubtest service, so it runs in seconds without any cloud resources.
+package pipeline
+
+import (
+	"context"
+	"google/jss/pubsub-integration/avro"
+	eventConfig "google/jss/pubsub-integration/eventgen/config"
+	"google/jss/pubsub-integration/eventgen/generator"
+	"google/jss/pubsub-integration/metrics"
+	ack "google/jss/pubsub-integration/metrics/ack/metrics"
+	complete "google/jss/pubsub-integration/metrics/complete/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	nack "google/jss/pubsub-integration/metrics/nack/metrics"
+	"google/jss/pubsub-integration/metrics/processor"
+	"google/jss/pubsub-integration/pubsub"
+	"google/jss/pubsub-integration/pubsub/pubsubtest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const errorSubscription = "ErrorSubscription"
+const maxDeliveryAttempts = 5
+
+// pipeline runs the event generator and the metrics processor against the in-memory Cloud Pub/Sub
+type pipeline struct {
+	t       *testing.T
+	fake    *pubsubtest.Service
+	client  pubsub.Client
+	cancel  context.CancelFunc
+	stopped sync.WaitGroup
+
+	mux          sync.Mutex
+	deadLettered []map[string]interface{}
+}
+
+func newPipeline(t *testing.T) *pipeline {
+	fake := pubsubtest.NewService()
+	pubsub.Service = fake
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pipeline{t: t, fake: fake, cancel: cancel}
+	t.Cleanup(p.close)
+
+	client, err := fake.NewClient(ctx, nil)
+	assert.Nil(t, err)
+	p.client = client
+
+	// The same resources with the Terraform setup
+	for _, topicID := range []string{eventConfig.Config.EventTopic, config.Config.ErrorTopic, config.Config.MetricsTopic} {
+		assert.Nil(t, client.CreateTopicIfNotExists(ctx, topicID))
+	}
+	assert.Nil(t, client.CreateSubscriptionIfNotExists(ctx, config.Config.EventSubscription, eventConfig.Config.EventTopic, config.Config.ErrorTopic, maxDeliveryAttempts, true))
+	assert.Nil(t, client.CreateSubscriptionIfNotExists(ctx, errorSubscription, config.Config.ErrorTopic, "", 0, false))
+
+	// Collects the dead lettered events
+	errorSub := client.NewSubscription(errorSubscription, config.Config.EventCodec, pubsub.ReceiveSettings{})
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		err := errorSub.Receive(ctx, func(ctx context.Context, message *pubsub.Message) {
+			p.mux.Lock()
+			defer p.mux.Unlock()
+			p.deadLettered = append(p.deadLettered, message.Data)
+			message.Ack() // nolint: errcheck
+		})
+		assert.Nil(t, err)
+	}()
+	return p
+}
+
+// run starts the metrics processor with the given factory and generates events for the given time
+func (p *pipeline) run(factory metrics.Factory, runtime time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		assert.Nil(p.t, processor.Start(ctx, factory))
+	}()
+	prevCancel := p.cancel
+	p.cancel = func() {
+		cancel()
+		prevCancel()
+	}
+
+	// Keep the number of events small, every event takes 0.1 ~ 0.3 seconds to be processed
+	p.fake.SetPublishLatency(eventConfig.Config.EventTopic, 20*time.Millisecond)
+	assert.Nil(p.t, generator.Start(generator.NewEvent, 2, runtime))
+	assert.Eventually(p.t, func() bool { return !generator.IsRunning() }, 10*time.Second, 10*time.Millisecond)
+}
+
+func (p *pipeline) close() {
+	generator.Stop()
+	p.cancel()
+	p.stopped.Wait()
+	p.client.Close() // nolint: errcheck
+	p.fake.Close()   // nolint: errcheck
+}
+
+func (p *pipeline) events() []map[string]interface{} {
+	return p.fake.Published(eventConfig.Config.EventTopic)
+}
+
+func (p *pipeline) metrics() []map[string]interface{} {
+	return p.fake.Published(config.Config.MetricsTopic)
+}
+
+func (p *pipeline) dead() []map[string]interface{} {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return append([]map[string]interface{}(nil), p.deadLettered...)
+}
+
+func sessionIDs(records []map[string]interface{}) map[interface{}]int {
+	ids := map[interface{}]int{}
+	for _, r := range records {
+		ids[r["session_id"]]++
+	}
+	return ids
+}
+
+// Every generated event becomes one metrics record, it returns the published metrics
+func testMetrics(t *testing.T, factory metrics.Factory) []map[string]interface{} {
+	p := newPipeline(t)
+	p.run(factory, 200*time.Millisecond)
+
+	events := sessionIDs(p.events())
+	assert.NotEmpty(t, events)
+	assert.Eventually(t, func() bool { return len(p.metrics()) >= len(events) }, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, events, sessionIDs(p.metrics()))
+	assert.Empty(t, p.dead())
+	return p.metrics()
+}
+
+func TestPipelineAck(t *testing.T) {
+	testMetrics(t, ack.New)
+}
+
+// The complete metrics are encoded with their own schema, not the one of METRICS_AVSC used by the other tests
+func TestPipelineComplete(t *testing.T) {
+	codec, err := avro.NewCodedecFromFile(filepath.Join(filepath.Dir(config.Config.MetricsAvsc), "MetricsComplete.avsc"))
+	assert.Nil(t, err)
+	prev := config.Config.MetricsCodec
+	config.Config.MetricsCodec = codec
+	t.Cleanup(func() { config.Config.MetricsCodec = prev })
+
+	published := testMetrics(t, complete.New)
+	assert.NotEmpty(t, published)
+	for _, m := range published {
+		json, err := avro.EncodeToJSON(codec, m)
+		assert.Nil(t, err)
+		assert.Contains(t, string(json), "battery_level_end")
+	}
+}
+
+// Every generated event is dead lettered after max delivery attempts and no metrics is generated
+func TestPipelineNack(t *testing.T) {
+	p := newPipeline(t)
+	p.run(nack.New, 100*time.Millisecond)
+
+	events := sessionIDs(p.events())
+	assert.NotEmpty(t, events)
+	assert.Eventually(t, func() bool { return len(p.dead()) >= len(events) }, 20*time.Second, 10*time.Millisecond)
+	assert.Equal(t, events, sessionIDs(p.dead()))
+	assert.Empty(t, p.metrics())
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"context"
+	"errors"
+	"google/jss/pubsub-integration/logging"
+	"google/jss/pubsub-integration/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/pubsub"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// The stages where the event fails
+const (
+	StageDecode   = "decode"
+	StageValidate = "validate"
+	StageFactory  = "factory"
+	StagePublish  = "publish"
+	StageTimeout  = "timeout"
+)
+
+// The attributes of the dead lettered event explaining the failure
+const (
+	ErrorAttribute           = "error"
+	StageAttribute           = "failure_stage"
+	DeliveryAttemptAttribute = "delivery_attempt"
+	NodeAttribute            = "processor_node"
+	TimestampAttribute       = "failure_timestamp"
+	MessageIDAttribute       = "original_message_id"
+	RuleAttribute            = "validation_rule"
+)
+
+// failure handles the event failed at the given stage
+type failure func(ctx context.Context, message *pubsub.Message, stage string, err error)
+
+// nackFailure nacks the event, so that it is redelivered and dead lettered by the subscription after max delivery attempts
+func nackFailure(ctx context.Context, message *pubsub.Message, stage string, err error) {
+	logging.FromContext(ctx).Info("nack the event", "stage", stage, "err", err)
+	nack(ctx, message)
+}
+
+// deadLetterFailure publishes the event to the error, quarantine or decode error topic as is with the failure reason as attributes, and then acks it.
+// The event is nacked if it can not be published to the error topic.
+func deadLetterFailure(errorTopic pubsub.Topic) failure {
+	return func(ctx context.Context, message *pubsub.Message, stage string, err error) {
+		logger := logging.FromContext(ctx)
+		attributes := map[string]string{}
+		for k, v := range message.Attributes {
+			attributes[k] = v
+		}
+		attributes[ErrorAttribute] = truncate(err.Error(), pubsub.MaxAttributeValueSize)
+		attributes[StageAttribute] = stage
+		attributes[NodeAttribute] = config.Config.Node
+		attributes[TimestampAttribute] = time.Now().UTC().Format(time.RFC3339Nano)
+		attributes[MessageIDAttribute] = message.ID
+		var invalid *metrics.InvalidEventError
+		if errors.As(err, &invalid) {
+			attributes[RuleAttribute] = invalid.Rule
+		}
+		if attempt := message.Attempt(); attempt > 0 {
+			attributes[DeliveryAttemptAttribute] = strconv.Itoa(attempt)
+		}
+
+		id, publishErr := errorTopic.PublishRaw(ctx, message.Message.Data, attributes)
+		if publishErr != nil {
+			logger.Error("fail to publish the event to error topic, nack the event", "stage", stage, "err", err, "publish_err", publishErr)
+			nack(ctx, message)
+			return
+		}
+		logger.Info("the event is published to error topic", "stage", stage, "err", err, "error_message_id", id)
+		count(DeadLettered)
+		ack(ctx, message)
+	}
+}
+
+// truncated marks the attribute value has been truncated
+const truncated = "...(truncated)"
+
+// truncate shortens the value to at most size bytes without splitting a UTF-8 character, so that it fits in a message attribute
+func truncate(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+	end := size - len(truncated)
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end] + truncated
+}
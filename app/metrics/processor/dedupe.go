@@ -0,0 +1,255 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"google/jss/pubsub-integration/metrics/config"
+	"log/slog"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// dedupeStore remembers the session IDs of the processed events within the retention window, so that the redelivered events are not processed twice
+type dedupeStore interface {
+	Contains(sessionID string, now time.Time) (bool, error) // whether the session ID is added within the retention window
+	Add(sessionID string, now time.Time) error
+	Close() error
+}
+
+// newDedupeStore creates the dedupe store given by DEDUPE_STORE, it returns nil if dedupe is off
+func newDedupeStore() (dedupeStore, error) {
+	switch config.Config.DedupeStore {
+	case "memory":
+		return newMemoryStore(config.Config.DedupeCacheSize, config.Config.DedupeRetention), nil
+	case "bolt":
+		return newBoltStore(config.Config.DedupePath, config.Config.DedupeRetention)
+	}
+	return nil, nil
+}
+
+// sessionLocks serializes the events of the same session ID, so that the concurrent redeliveries are not processed at the same time.
+// The later one checks the dedupe store after the earlier one is done, so it is skipped if the earlier one has been processed.
+type sessionLocks struct {
+	mux     sync.Mutex
+	pending map[string]chan struct{} // closed when the event of the session ID is done
+}
+
+func newSessionLocks() *sessionLocks {
+	return &sessionLocks{pending: map[string]chan struct{}{}}
+}
+
+// lock waits until no other event of the session ID is being processed, and returns the function to unlock it.
+// It returns the error if the context is done before that.
+func (l *sessionLocks) lock(ctx context.Context, sessionID string) (func(), error) {
+	for {
+		l.mux.Lock()
+		done, busy := l.pending[sessionID]
+		if !busy {
+			done = make(chan struct{})
+			l.pending[sessionID] = done
+			l.mux.Unlock()
+			return func() {
+				l.mux.Lock()
+				delete(l.pending, sessionID)
+				l.mux.Unlock()
+				close(done)
+			}, nil
+		}
+		l.mux.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// expired reports whether the session ID added at the given time is out of the retention window, 0 retention keeps it forever
+func expired(added time.Time, now time.Time, retention time.Duration) bool {
+	return retention > 0 && now.Sub(added) > retention
+}
+
+// memoryStore keeps the latest session IDs in memory up to the given size, the least recently added ones are evicted first
+type memoryStore struct {
+	mux       sync.Mutex
+	size      int
+	retention time.Duration
+	order     *list.List               // the session entries from the most to the least recently added
+	entries   map[string]*list.Element // the elements of order keyed by session ID
+}
+
+type memoryEntry struct {
+	sessionID string
+	added     time.Time
+}
+
+func newMemoryStore(size int, retention time.Duration) *memoryStore {
+	return &memoryStore{
+		size:      size,
+		retention: retention,
+		order:     list.New(),
+		entries:   map[string]*list.Element{},
+	}
+}
+
+func (s *memoryStore) Contains(sessionID string, now time.Time) (bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.entries[sessionID]
+	if !ok {
+		return false, nil
+	}
+	if expired(e.Value.(*memoryEntry).added, now, s.retention) {
+		s.order.Remove(e)
+		delete(s.entries, sessionID)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *memoryStore) Add(sessionID string, now time.Time) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.entries[sessionID]; ok {
+		e.Value.(*memoryEntry).added = now
+		s.order.MoveToFront(e)
+		return nil
+	}
+	s.entries[sessionID] = s.order.PushFront(&memoryEntry{sessionID: sessionID, added: now})
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).sessionID)
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// sessionsBucket is the bolt bucket of the session IDs, the value is the added time in Unix nanoseconds
+var sessionsBucket = []byte("sessions")
+
+// boltStore keeps the session IDs in a local bolt file, so that they are remembered across restarts
+type boltStore struct {
+	db        *bolt.DB
+	retention time.Duration
+	mux       sync.Mutex
+	purged    time.Time // the expired session IDs are purged once every retention window
+}
+
+// newBoltStore opens the bolt file and removes the expired session IDs in it
+func newBoltStore(path string, retention time.Duration) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("fail to open dedupe store: %v, err: %w", path, err)
+	}
+	s := &boltStore{db: db, retention: retention, purged: time.Now()}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	}); err != nil {
+		db.Close() // nolint: errcheck
+		return nil, fmt.Errorf("fail to create dedupe bucket, err: %w", err)
+	}
+	removed, err := s.purge(time.Now())
+	if err != nil {
+		db.Close() // nolint: errcheck
+		return nil, err
+	}
+	slog.Info("open dedupe store", "path", path, "removed", removed)
+	return s, nil
+}
+
+func (s *boltStore) Contains(sessionID string, now time.Time) (bool, error) {
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(sessionsBucket).Get([]byte(sessionID))
+		found = v != nil && !expired(decodeTime(v), now, s.retention)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("fail to look up session: %v, err: %w", sessionID, err)
+	}
+	return found, nil
+}
+
+func (s *boltStore) Add(sessionID string, now time.Time) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(sessionID), encodeTime(now))
+	})
+	if err != nil {
+		return fmt.Errorf("fail to add session: %v, err: %w", sessionID, err)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if expired(s.purged, now, s.retention) {
+		s.purged = now
+		removed, err := s.purge(now)
+		if err != nil {
+			return err
+		}
+		slog.Debug("purge dedupe store", "removed", removed)
+	}
+	return nil
+}
+
+// purge removes the session IDs out of the retention window and returns the number of them
+func (s *boltStore) purge(now time.Time) (int, error) {
+	var removed int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		var keys [][]byte // the keys are deleted after iterating, since deleting with the cursor may skip the next key
+		if err := bucket.ForEach(func(k, v []byte) error {
+			if expired(decodeTime(v), now, s.retention) {
+				keys = append(keys, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("fail to purge dedupe store, err: %w", err)
+	}
+	return removed, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func encodeTime(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+}
+
+func decodeTime(v []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+}
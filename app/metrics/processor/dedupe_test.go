@@ -0,0 +1,100 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The memory store evicts the least recently added session IDs beyond the size
+func TestMemoryStore(t *testing.T) {
+	s := newMemoryStore(2, time.Hour)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, s.Add(fmt.Sprint(i), now))
+	}
+	found, err := s.Contains("0", now)
+	assert.Nil(t, err)
+	assert.False(t, found)
+	for _, id := range []string{"1", "2"} {
+		found, err := s.Contains(id, now)
+		assert.Nil(t, err)
+		assert.True(t, found)
+	}
+
+	// The session IDs are forgotten after the retention window
+	found, err = s.Contains("1", now.Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+// The bolt store remembers the session IDs across reopening within the retention window
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedupe.db")
+	s, err := newBoltStore(path, time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Add("old", time.Now().Add(-2*time.Hour)))
+	assert.Nil(t, s.Add("new", time.Now()))
+	assert.Nil(t, s.Close())
+
+	s, err = newBoltStore(path, time.Hour)
+	assert.Nil(t, err)
+	defer s.Close() // nolint: errcheck
+	found, err := s.Contains("new", time.Now())
+	assert.Nil(t, err)
+	assert.True(t, found)
+	found, err = s.Contains("old", time.Now())
+	assert.Nil(t, err)
+	assert.False(t, found)
+	found, err = s.Contains("unknown", time.Now())
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// The expired session ID is removed when the store is opened
+	removed, err := s.purge(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+// The same session ID is locked by one event at a time, the other session IDs are not blocked
+func TestSessionLocks(t *testing.T) {
+	l := newSessionLocks()
+	unlock, err := l.lock(context.Background(), "a")
+	assert.Nil(t, err)
+	unlockB, err := l.lock(context.Background(), "b")
+	assert.Nil(t, err)
+	unlockB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = l.lock(ctx, "a")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := l.lock(context.Background(), "a")
+		assert.Nil(t, err)
+		unlock()
+		close(locked)
+	}()
+	unlock()
+	<-locked
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"google/jss/pubsub-integration/metrics/config"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const zScore = 3.29 // the z-score for 99.9% confidence interval
+
+// processingTimeModels generate the random processing time in seconds, keyed by PROCESSING_TIME_MODEL.
+// The fixed model is not one of them, it is always PROCESSING_TIME_FIXED.
+var processingTimeModels = map[string]func(config.ProcessingTime) float64{
+	// uniform is evenly distributed between min and max
+	"uniform": func(s config.ProcessingTime) float64 {
+		return s.Min.Seconds() + rand.Float64()*(s.Max.Seconds()-s.Min.Seconds())
+	},
+	// normal is 99.9% of the time between min and max
+	"normal": func(s config.ProcessingTime) float64 {
+		return normal(s.Min, s.Max)
+	},
+	// lognormal has the median in the middle of min and max, and a heavy tail given by sigma
+	"lognormal": func(s config.ProcessingTime) float64 {
+		median := (s.Min.Seconds() + s.Max.Seconds()) / 2
+		return median * math.Exp(rand.NormFloat64()*s.Sigma)
+	},
+	// bimodal is normal between slow min and slow max by the slow ratio, otherwise normal between min and max
+	"bimodal": func(s config.ProcessingTime) float64 {
+		if rand.Float64() < s.SlowRatio {
+			return normal(s.SlowMin, s.SlowMax)
+		}
+		return normal(s.Min, s.Max)
+	},
+}
+
+func normal(lower time.Duration, upper time.Duration) float64 {
+	mean := (lower.Seconds() + upper.Seconds()) / 2
+	stdDev := (upper.Seconds() - mean) / zScore
+	return rand.NormFloat64()*stdDev + mean
+}
+
+// ProcessingTime returns a random processing time to simulate the time used to process an event.
+// The distribution is given by PROCESSING_TIME_MODEL and its settings, they can be reloaded live.
+// By default it is normal distributed between 0.1 and 5 seconds and 99.9% of the time between 0.1 and 0.3 seconds.
+func ProcessingTime() time.Duration {
+	s := config.GetProcessingTime()
+	if s.Model == "fixed" {
+		// The fixed time is given explicitly, so it is not bounded by min and limit
+		return s.Fixed
+	}
+	if s.Max < s.Min {
+		s.Max = s.Min
+	}
+	if s.SlowMax < s.SlowMin {
+		s.SlowMax = s.SlowMin
+	}
+	if s.Limit < s.Min {
+		s.Limit = s.Min
+	}
+	model, ok := processingTimeModels[s.Model]
+	if !ok {
+		model = processingTimeModels["normal"]
+	}
+
+	// Resample the time out of the min and limit, it is clamped if the model keeps giving time out of range
+	var seconds float64
+	for i := 0; i < 100; i++ {
+		seconds = model(s)
+		if seconds >= s.Min.Seconds() && seconds <= s.Limit.Seconds() {
+			break
+		}
+	}
+	seconds = math.Min(math.Max(seconds, s.Min.Seconds()), s.Limit.Seconds())
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"google/jss/pubsub-integration/metrics/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useProcessingTimeModel sets the live processing time settings under the config lock, and restores them after the test
+func useProcessingTimeModel(t *testing.T, model string, update ...func()) {
+	var restore func()
+	config.Update(func() {
+		prev := config.Config
+		restore = func() { config.Config = prev }
+		config.Config.ProcessingTimeModel = model
+		for _, f := range update {
+			f()
+		}
+	})
+	t.Cleanup(func() { config.Update(restore) })
+}
+
+// samples returns the processing time in seconds
+func samples(n int) []float64 {
+	result := make([]float64, n)
+	for i := range result {
+		result[i] = ProcessingTime().Seconds()
+	}
+	return result
+}
+
+func countBetween(values []float64, lower float64, upper float64) int {
+	var n int
+	for _, v := range values {
+		if v >= lower && v <= upper {
+			n++
+		}
+	}
+	return n
+}
+
+// The fixed time is used as is, even out of min and limit
+func TestProcessingTimeFixed(t *testing.T) {
+	useProcessingTimeModel(t, "fixed")
+	assert.Equal(t, 200*time.Millisecond, ProcessingTime()) // the default of PROCESSING_TIME_FIXED
+
+	useProcessingTimeModel(t, "fixed", func() { config.Config.ProcessingTimeFixed = 10 * time.Millisecond })
+	assert.Equal(t, 10*time.Millisecond, ProcessingTime())
+
+	useProcessingTimeModel(t, "fixed", func() { config.Config.ProcessingTimeFixed = 10 * time.Second })
+	assert.Equal(t, 10*time.Second, ProcessingTime())
+}
+
+func TestProcessingTimeUniform(t *testing.T) {
+	useProcessingTimeModel(t, "uniform")
+	values := samples(10000)
+	assert.Equal(t, 10000, countBetween(values, 0.1, 0.3))
+	assert.InDelta(t, 5000, countBetween(values, 0.1, 0.2), 300) // half of the time is in the lower half
+}
+
+// The lognormal has a heavy tail above max, but never above the limit
+func TestProcessingTimeLognormal(t *testing.T) {
+	useProcessingTimeModel(t, "lognormal")
+	values := samples(10000)
+	assert.Equal(t, 10000, countBetween(values, 0.1, 5))
+	assert.Greater(t, countBetween(values, 1, 5), 100)
+}
+
+func TestProcessingTimeBimodal(t *testing.T) {
+	useProcessingTimeModel(t, "bimodal")
+	values := samples(10000)
+	assert.InDelta(t, 9000, countBetween(values, 0.1, 0.3), 300)
+	assert.InDelta(t, 1000, countBetween(values, 1, 3), 300)
+}
@@ -17,95 +17,411 @@ package processor
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"google/jss/pubsub-integration/logging"
 	"google/jss/pubsub-integration/metrics"
 	"google/jss/pubsub-integration/metrics/config"
+	_ "google/jss/pubsub-integration/metrics/quality" // registers the quality middleware
+	"google/jss/pubsub-integration/metrics/sink"
 	"google/jss/pubsub-integration/pubsub"
-	"log"
-	"math/rand"
+	"google/jss/pubsub-integration/tracing"
+	"log/slog"
+	"maps"
 	"time"
 )
 
 // Creates a Cloud Pub/Sub subscription to receive event and then generate metrics
 func Start(ctx context.Context, factory metrics.Factory) error {
+	return start(ctx, factory, true)
+}
+
+// StartConsumer is the same with Start, but the factory consumes the events without metrics, e.g. the aggregate metrics publishes the windows by itself.
+// No metrics sink is created, so METRICS_SINKS is ignored.
+func StartConsumer(ctx context.Context, factory metrics.Factory) error {
+	return start(ctx, factory, false)
+}
+
+func start(ctx context.Context, factory metrics.Factory, withSinks bool) error {
 	client, err := pubsub.Service.NewClient(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer client.Close() // nolint: errcheck
 
+	// Reload the settings can be changed live, e.g. the processing time
+	go config.Watch(ctx)
+	go reportStats(ctx, config.Config.StatsInterval)
+
+	if pubsub.UsingEmulator() {
+		if err := createResources(ctx, client); err != nil {
+			return err
+		}
+	}
+
 	// The subscription to receive event
-	sub := client.NewSubscription(config.Config.EventSubscription, config.Config.EventCodec, config.Config.SubscriberNumGoroutines, config.Config.SubscriberMaxOutstanding)
+	sub := client.NewSubscription(config.Config.EventSubscription, config.Config.EventCodec, config.ReceiveSettings())
+	for revisionID, codec := range config.Config.EventRevisions {
+		if err := sub.AddRevision(revisionID, codec); err != nil {
+			return err
+		}
+	}
 
-	// The topic to publish the metrics converted from received event
-	metricsTopic := client.NewTopic(config.Config.MetricsTopic, config.Config.MetricsCodec, config.Config.PublisherBatchSize, config.Config.PublisherNumGoroutines, 0)
-	defer metricsTopic.Stop()
+	// The sinks to write the metrics converted from received event, e.g. the metrics topic and local files
+	var sinks []sink.Sink
+	if withSinks {
+		var err error
+		sinks, err = sink.FromConfig(func() pubsub.Topic {
+			return client.NewTopic(config.Config.MetricsTopic, config.Config.MetricsCodec, config.PublishSettings())
+		})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := sink.Close(sinks); err != nil {
+				slog.Error("fail to close metrics sinks", "err", err)
+			}
+		}()
+	}
 
-	// The handler to handles the received event, generate and publish metrics to the metrics topic
-	handler := eventHandler(metricsTopic, factory)
+	// The failed events are nacked to be dead lettered by the subscription, or published to the error topic directly
+	var errorTopic pubsub.Topic
+	if config.Config.DeadLetterPublish || config.Config.ProcessingTimeoutPolicy == "dead-letter" {
+		errorTopic = client.NewTopic(config.Config.ErrorTopic, config.Config.EventCodec, config.PublishSettings())
+		defer errorTopic.Stop()
+	}
+	fail := nackFailure
+	if config.Config.DeadLetterPublish {
+		fail = deadLetterFailure(errorTopic)
+	}
+	// The timed out events are nacked, or published to the error topic by PROCESSING_TIMEOUT_POLICY
+	timedOut := nackFailure
+	if config.Config.ProcessingTimeoutPolicy == "dead-letter" {
+		timedOut = deadLetterFailure(errorTopic)
+	}
+	// The invalid events are published to the quarantine topic, or handled as the other failures if it is not set
+	quarantine := fail
+	if config.Config.QuarantineTopic != "" {
+		quarantineTopic := client.NewTopic(config.Config.QuarantineTopic, config.Config.EventCodec, config.PublishSettings())
+		defer quarantineTopic.Stop()
+		quarantine = deadLetterFailure(quarantineTopic)
+	}
+	// The undecodable events would be rejected by the error topic enforcing the event schema, so they are published as is to a topic without schema
+	decodeFail := nackFailure
+	if config.Config.DecodeErrorTopic != "" {
+		decodeErrorTopic := client.NewTopic(config.Config.DecodeErrorTopic, nil, config.PublishSettings())
+		defer decodeErrorTopic.Stop()
+		decodeFail = deadLetterFailure(decodeErrorTopic)
+	}
+	sub.OnDecodeError(func(ctx context.Context, message *pubsub.Message, err error) {
+		count(DecodeFailed)
+		decodeFail(ctx, message, StageDecode, err)
+	})
+
+	// The session IDs of the processed events to skip the redelivered ones, it is nil if DEDUPE_STORE is off
+	dedupe, err := newDedupeStore()
+	if err != nil {
+		return err
+	}
+	if dedupe != nil {
+		defer dedupe.Close() // nolint: errcheck
+	}
+
+	// The middlewares given by METRICS_MIDDLEWARES wrap the factory, e.g. validate and filter the event before generating metrics
+	factory, err = metrics.FromConfig(ctx, factory)
+	if err != nil {
+		return err
+	}
+
+	// The handler to handles the received event, generate and write metrics to the sinks
+	handler := eventHandler(sinks, factory, fail, quarantine, timedOut, dedupe)
+
+	// The push subscription sends the event to the HTTP endpoint instead
+	if config.Config.SubscriptionMode == "push" {
+		return servePush(ctx, sub, handler)
+	}
 
 	// Start to handle received event using given handler.
-	// It does not return until the context is done
+	// It does not return until the context is done or a permanent error occurs
+	return receiveLoop(ctx, sub.ID, func(ctx context.Context) error {
+		return sub.Receive(ctx, handler)
+	})
+}
+
+// receiveLoop calls receive until the context is done or a permanent error occurs, the transient errors are retried with backoff
+func receiveLoop(ctx context.Context, subID string, receive func(context.Context) error) error {
+	backoff := pubsub.NewBackoff(config.Config.SubscriberRetryInit, config.Config.SubscriberRetryMax)
 	for {
-		if err := sub.Receive(ctx, handler); err != nil {
-			log.Printf("sub.Receive: %v", err)
+		started := time.Now()
+		err := receive(ctx)
+		if ctx.Err() != nil {
+			slog.Info("context done, subscriber stopped")
+			return nil
+		}
+		if pubsub.IsPermanent(err) {
+			return fmt.Errorf("fail to receive from subscription: %v, err: %w", subID, err)
 		}
+		if time.Since(started) > config.Config.SubscriberRetryMax {
+			// It has been receiving for a while, so the error is not the same one that keeps failing
+			backoff = pubsub.NewBackoff(config.Config.SubscriberRetryInit, config.Config.SubscriberRetryMax)
+		}
+		wait := backoff.Pause()
+		slog.Warn("fail to receive, waiting for retry", logging.Subscription, subID, "err", err, "wait", wait, Restarts, count(Restarts))
 		select {
 		case <-ctx.Done():
-			log.Printf("context done, subscriber stopped")
+			slog.Info("context done, subscriber stopped")
 			return nil
-		default:
-			waitTime := 30 * time.Second
-			log.Printf("waiting %v for retry", waitTime)
-			time.Sleep(waitTime)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// createResources creates the topics and subscription used by the processor if they do not exist.
+// It mirrors the Terraform setup so that the processor can run with the Cloud Pub/Sub emulator.
+func createResources(ctx context.Context, client pubsub.Client) error {
+	topicIDs := []string{config.Config.EventTopic, config.Config.ErrorTopic, config.Config.MetricsTopic}
+	if config.Config.QuarantineTopic != "" {
+		topicIDs = append(topicIDs, config.Config.QuarantineTopic)
+	}
+	if config.Config.DecodeErrorTopic != "" {
+		topicIDs = append(topicIDs, config.Config.DecodeErrorTopic)
+	}
+	for _, topicID := range topicIDs {
+		if err := client.CreateTopicIfNotExists(ctx, topicID); err != nil {
+			return err
 		}
 	}
+	// Synchronous pull does not work with exactly-once delivery
+	return client.CreateSubscriptionIfNotExists(ctx, config.Config.EventSubscription, config.Config.EventTopic, config.Config.ErrorTopic, config.Config.MaxDeliveryAttempts, !config.Config.SubscriberSynchronous)
 }
 
 // eventHandler creates the event message handler for subscriber to handle the received event
 // The handler receives event message and generates metrics using the given metrics factory
-// It acks the message and publishes the metrics to the metrics topic if it generates metrics successfully or nacks if it does not
-func eventHandler(metricsTopic pubsub.Topic, factory metrics.Factory) pubsub.MessageHandler {
+// It acks the message and writes the metrics to the sinks if it generates metrics successfully or hands it to fail if it does not.
+// If the metrics can not be written to any of the sinks, the event is handed to fail or acked by METRICS_PUBLISH_FAILURE_POLICY.
+// The duplicate event whose session ID is in the dedupe store is acked without publishing the metrics again.
+// With the dedupe store, the events of the same session ID are processed one at a time, so that the concurrent redeliveries are deduplicated as well.
+// The event is acked without publishing if the factory returns nil metrics.
+// The processing and the factory are bounded by PROCESSING_TIMEOUT and the lease deadline of the message, the timed out event is handed to timedOut.
+func eventHandler(sinks []sink.Sink, factory metrics.Factory, fail failure, quarantine failure, timedOut failure, dedupe dedupeStore) pubsub.MessageHandler {
+	// sinks: the destinations of the metrics, e.g. the metrics topic
 	// factory: the metrics factory to generate metrics from the received event
+	// fail: nacks or dead letters the failed event
+	// quarantine: routes the event failed with metrics.InvalidEventError
+	// timedOut: nacks or dead letters the event not processed in time
+	// dedupe: the session IDs of the processed events, nil to process every event
 
+	locks := newSessionLocks()
 	return func(ctx context.Context, message *pubsub.Message) {
-		log.Printf("processing event ID: %v, data: %v", message.ID, message.Data)
+		logger := logging.FromContext(ctx) // attached with the subscription and message ID
+		logger.Debug("processing event", "data", message.Data)
 
+		sessionID, _ := message.Data["session_id"].(string)
+		if dedupe != nil {
+			// The concurrent redelivery waits, and then it is found in the dedupe store if this one is processed
+			unlock, err := locks.lock(ctx, sessionID)
+			if err != nil {
+				logger.Info("context done, nack the event", "err", err)
+				nack(ctx, message)
+				return
+			}
+			defer unlock()
+			duplicate, err := dedupe.Contains(sessionID, time.Now())
+			if err != nil {
+				logger.Error("fail to check duplicate event, process it anyway", "session_id", sessionID, "err", err)
+			}
+			if duplicate {
+				logger.Info("duplicate event, ack it without publishing metrics", "session_id", sessionID)
+				count(Duplicates)
+				ack(ctx, message)
+				return
+			}
+		}
+
+		processCtx, cancel := processingContext(ctx, message)
+		defer cancel()
+		_, span := tracing.Start(ctx, "processing")
 		processingTime := ProcessingTime()
-		time.Sleep(processingTime) // Simulate processing time
+		err := simulateProcessing(processCtx, processingTime)
+		tracing.End(span, err)
 
-		ackTime := time.Now()
-		metrics, err := factory(message.Data, message.PublishTime, ackTime, processingTime)
+		var invalid *metrics.InvalidEventError // declared before the metrics variable shadows the package
+		var metrics map[string]interface{}
+		if err == nil {
+			ackTime := time.Now()
+			_, span = tracing.Start(ctx, "factory")
+			metrics, err = callFactory(processCtx, factory, message, ackTime, processingTime)
+			tracing.End(span, err)
+		}
+		if err != nil && ctx.Err() != nil {
+			// The subscriber is stopping, the event will be redelivered anyway
+			logger.Info("context done, nack the event", "err", err)
+			nack(ctx, message)
+			return
+		}
+		if err != nil && errors.Is(processCtx.Err(), context.DeadlineExceeded) {
+			logger.Warn("processing timed out", "err", err, "lease_time_left", message.LeaseTimeLeft())
+			count(TimedOut)
+			timedOut(ctx, message, StageTimeout, err)
+			return
+		}
+		if errors.As(err, &invalid) {
+			logger.Info("invalid event", "rule", invalid.Rule, "err", invalid.Err)
+			count(Invalid + invalid.Rule)
+			quarantine(ctx, message, StageValidate, err)
+			return
+		}
 		if err != nil {
-			log.Printf("nack the event ID: %v, error: %v", message.ID, err)
-			message.Nack()
+			count(FactoryFailed)
+			fail(ctx, message, StageFactory, err)
+			return
+		}
+		if metrics == nil {
+			// The factory consumes the event without metrics to publish, e.g. the aggregate metrics publishes the windows by itself
+			logger.Debug("event is consumed by the metrics factory")
+			remember(ctx, dedupe, sessionID)
+			if ack(ctx, message) {
+				count(Acked)
+			}
 			return
 		}
-		log.Printf("event ID: %v converted to metrics: %v", message.ID, metrics)
-		id, err := metricsTopic.Publish(ctx, metrics)
+		logger.Debug("event converted to metrics", "metrics", metrics)
+		ids, err := writeMetrics(ctx, sinks, metrics)
 		if err != nil {
-			log.Println(err)
+			if config.Config.MetricsPublishFailurePolicy != "best-effort" {
+				logger.Error("fail to publish metrics", "err", err)
+				count(PublishFailed)
+				fail(ctx, message, StagePublish, err)
+				return
+			}
+			logger.Error("fail to publish metrics, ack the event in best-effort mode", "err", err)
+			count(PublishDropped)
 		} else {
-			log.Printf("event ID: %v is processed and published to metiric topic as message ID: %v", message.ID, id)
+			logger.Info("event is processed and written to metrics sinks", "metrics_ids", ids)
+			remember(ctx, dedupe, sessionID)
+		}
+		logger.Debug("ack the event")
+		if ack(ctx, message) {
+			count(Acked)
 		}
-		log.Printf("ack the event ID: %v", message.ID)
-		message.Ack()
 	}
 }
 
-var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+// processingContext returns the context done at PROCESSING_TIMEOUT or the lease deadline of the message, whichever is earlier.
+// The event is redelivered after the lease deadline anyway, so it is not worth processing any longer.
+// The lease deadline of the pulled event is the max extension, 60 minutes by default, so PROCESSING_TIMEOUT is usually the bound.
+func processingContext(ctx context.Context, message *pubsub.Message) (context.Context, context.CancelFunc) {
+	deadline := message.LeaseDeadline()
+	if timeout := config.Config.ProcessingTimeout; timeout > 0 {
+		if timeoutAt := time.Now().Add(timeout); deadline.IsZero() || timeoutAt.Before(deadline) {
+			deadline = timeoutAt
+		}
+	}
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
 
-const proesssTimeMin = 0.1
-const processTimeMax = 0.3
-const processTimeMean = (proesssTimeMin + processTimeMax) / 2
-const processTimeStdDev = (processTimeMax - processTimeMean) / 3.29 // 3.29 is the z-score for 99.9% confidence interval
+// simulateProcessing waits for the processing time unless the context is done before it
+func simulateProcessing(ctx context.Context, processingTime time.Duration) error {
+	timer := time.NewTimer(processingTime)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("processing is not finished in %v, err: %w", processingTime, ctx.Err())
+	}
+}
 
-// ProcessingTime returns a normal distributed random processing time to simulate the time used to process an event
-// It is between 0.1 and 0.5 seconds and 99.9% of the time between 0.1 and 0.3 seconds
-func ProcessingTime() time.Duration {
-	for {
-		seconds := random.NormFloat64()*processTimeStdDev + processTimeMean
-		if seconds >= proesssTimeMin && seconds <= 5.0 {
-			return time.Duration(seconds * float64(time.Second))
+// callFactory calls the factory in another goroutine, so that a stuck factory does not hold the event after the context is done.
+// The abandoned factory keeps running until it returns and its result is dropped, e.g. the aggregate metrics may still count the event.
+// The factory gets a copy of the event, so that the abandoned one changing it, e.g. the enrich middleware, does not race with the dead lettering.
+func callFactory(ctx context.Context, factory metrics.Factory, message *pubsub.Message, ackTime time.Time, processingTime time.Duration) (map[string]interface{}, error) {
+	type result struct {
+		metrics map[string]interface{}
+		err     error
+	}
+	event := maps.Clone(message.Data)
+	done := make(chan result, 1)
+	go func() {
+		metrics, err := factory(event, message.PublishTime, ackTime, processingTime, message.Attempt())
+		done <- result{metrics, err}
+	}()
+	select {
+	case r := <-done:
+		return r.metrics, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("the metrics factory does not return in time, err: %w", ctx.Err())
+	}
+}
+
+// remember adds the session ID of the processed event to the dedupe store if it is enabled
+func remember(ctx context.Context, dedupe dedupeStore, sessionID string) {
+	if dedupe == nil {
+		return
+	}
+	if err := dedupe.Add(sessionID, time.Now()); err != nil {
+		logging.FromContext(ctx).Error("fail to add the event to dedupe store", "session_id", sessionID, "err", err)
+	}
+}
+
+// ack acks the event and reports whether it succeeds, the failed ack is logged and counted
+func ack(ctx context.Context, message *pubsub.Message) bool {
+	if err := message.Ack(); err != nil {
+		logging.FromContext(ctx).Error("fail to ack the event, it will be redelivered", "err", err)
+		count(AckFailed)
+		return false
+	}
+	return true
+}
+
+// nack nacks the event and reports whether it succeeds, the failed nack is logged and counted
+func nack(ctx context.Context, message *pubsub.Message) bool {
+	if err := message.Nack(); err != nil {
+		logging.FromContext(ctx).Error("fail to nack the event, it will be redelivered after the ack deadline", "err", err)
+		count(NackFailed)
+		return false
+	}
+	return true
+}
+
+// writeMetrics writes the metrics to every sink and returns the written IDs keyed by the sink name.
+// A failed sink does not stop the others, so the metrics may be written to the succeeded sinks again when the event is redelivered.
+func writeMetrics(ctx context.Context, sinks []sink.Sink, metrics map[string]interface{}) (map[string]string, error) {
+	ids := map[string]string{}
+	var errs []error
+	for _, s := range sinks {
+		writeCtx, span := tracing.Start(ctx, s.Name()+" publish", tracing.Producer)
+		id, err := publishMetrics(writeCtx, s, metrics) // the metrics continue the trace of the event
+		tracing.End(span, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("fail to write metrics to sink: %v, err: %w", s.Name(), err))
+			continue
+		}
+		ids[s.Name()] = id
+	}
+	return ids, errors.Join(errs...)
+}
+
+// publishMetrics writes the metrics to the sink, the failed write is retried with backoff if METRICS_PUBLISH_FAILURE_POLICY is retry
+func publishMetrics(ctx context.Context, s sink.Sink, metrics map[string]interface{}) (string, error) {
+	id, err := s.Write(ctx, metrics)
+	if err == nil || config.Config.MetricsPublishFailurePolicy != "retry" {
+		return id, err
+	}
+	backoff := pubsub.NewBackoff(config.Config.MetricsPublishRetryInit, config.Config.MetricsPublishRetryMax)
+	for i := 0; i < config.Config.MetricsPublishRetries && err != nil; i++ {
+		wait := backoff.Pause()
+		logging.FromContext(ctx).Warn("fail to publish metrics, waiting for retry", "err", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(wait):
 		}
+		count(PublishRetries)
+		id, err = s.Write(ctx, metrics)
 	}
+	return id, err
 }
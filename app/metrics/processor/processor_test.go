@@ -16,9 +16,33 @@
 package processor
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/eventgen/generator"
+	"google/jss/pubsub-integration/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/metrics/sink"
+	"google/jss/pubsub-integration/pubsub"
+	"google/jss/pubsub-integration/pubsub/pubsubtest"
+	"google/jss/pubsub-integration/tracing"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	gpubsub "cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // TestProcessingTime tests the processing time is between 0.1 and 5 seconds and 99.4% of processing time is between 0.1 and 0.3 seconds
@@ -34,3 +58,576 @@ func TestProcessTime(t *testing.T) {
 	}
 	assert.True(t, count >= 9940) // 99.4% (0.5% error margin) of processing time should be between 0.1 and 0.3 seconds
 }
+
+const (
+	eventTopic        = "EventTopic"
+	eventSubscription = "EventSubscription"
+	metricsTopic      = "MetricsTopic"
+)
+
+// newEvent creates the event published by receive, the tests can replace it to publish the same event again
+var newEvent = generator.NewEvent
+
+// receive publishes the event to the fake event topic and handles it using the event handler with the given factory
+// It returns the fake service and the published event message when the event has been handled
+// The setup functions can script the fake service before the event is handled.
+func receive(t *testing.T, factory metrics.Factory, setup ...func(*pubsubtest.Service)) (*pubsubtest.Service, *pstest.Message) {
+	return receiveFrom(t, pubsubtest.NewService(), factory, setup...)
+}
+
+// receiveFrom is the same with receive, but uses the given fake service
+func receiveFrom(t *testing.T, fake *pubsubtest.Service, factory metrics.Factory, setup ...func(*pubsubtest.Service)) (*pubsubtest.Service, *pstest.Message) {
+	t.Cleanup(func() { fake.Close() }) // nolint: errcheck
+	for _, f := range setup {
+		f(fake)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := fake.NewClient(ctx, nil)
+	assert.Nil(t, err)
+	defer client.Close() // nolint: errcheck
+	events := client.NewTopic(eventTopic, config.Config.EventCodec, pubsub.PublishSettings{})
+	defer events.Stop()
+	assert.Nil(t, client.CreateSubscriptionIfNotExists(ctx, eventSubscription, eventTopic, "", 0, true))
+	sub := client.NewSubscription(eventSubscription, config.Config.EventCodec, pubsub.ReceiveSettings{NumGoroutines: 1, MaxOutstandingMessages: 1})
+	topic := client.NewTopic(metricsTopic, config.Config.MetricsCodec, pubsub.PublishSettings{CountThreshold: 1})
+	defer topic.Stop()
+
+	publishCtx, span := tracing.Start(ctx, "publish event", tracing.Producer)
+	id, err := events.Publish(publishCtx, newEvent())
+	span.End()
+	assert.Nil(t, err)
+
+	// Only the first delivery is handled, so that the redelivered event does not change the result.
+	// The redelivered event is nacked, since Receive does not return until all the messages are acked or nacked.
+	// The handler returns after the ack result is known, since the subscription enables exactly-once delivery.
+	errorTopic := client.NewTopic(config.Config.ErrorTopic, config.Config.EventCodec, pubsub.PublishSettings{CountThreshold: 1})
+	defer errorTopic.Stop()
+	fail := nackFailure
+	if config.Config.DeadLetterPublish {
+		fail = deadLetterFailure(errorTopic)
+	}
+	timedOut := nackFailure
+	if config.Config.ProcessingTimeoutPolicy == "dead-letter" {
+		timedOut = deadLetterFailure(errorTopic)
+	}
+	quarantine := fail
+	if config.Config.QuarantineTopic != "" {
+		quarantineTopic := client.NewTopic(config.Config.QuarantineTopic, config.Config.EventCodec, pubsub.PublishSettings{CountThreshold: 1})
+		defer quarantineTopic.Stop()
+		quarantine = deadLetterFailure(quarantineTopic)
+	}
+	dedupe, err := newDedupeStore()
+	assert.Nil(t, err)
+	if dedupe != nil {
+		defer dedupe.Close() // nolint: errcheck
+	}
+	var handled, returned atomic.Bool
+	handler := eventHandler([]sink.Sink{sink.NewTopic(topic)}, factory, fail, quarantine, timedOut, dedupe)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sub.Receive(ctx, func(ctx context.Context, message *pubsub.Message) { // nolint: errcheck
+			if handled.CompareAndSwap(false, true) {
+				handler(ctx, message)
+				returned.Store(true)
+			} else {
+				message.Nack() // nolint: errcheck
+			}
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	assert.Eventually(t, returned.Load, 5*time.Second, 10*time.Millisecond)
+	return fake, fake.Server.Message(id)
+}
+
+// nacked reports whether the message is nacked, which is a modack with zero deadline
+func nacked(msg *pstest.Message) bool {
+	for _, modack := range msg.Modacks {
+		if modack.AckDeadline == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// The event is acked and the metrics is published to the metrics topic
+func TestEventHandlerAck(t *testing.T) {
+	fake, msg := receive(t, metrics.New)
+	assert.Equal(t, 1, msg.Acks)
+
+	published := fake.Published(metricsTopic)
+	assert.Equal(t, 1, len(published))
+	event, err := avro.DecodeFromJSON(config.Config.EventCodec, msg.Data)
+	assert.Nil(t, err)
+	assert.Equal(t, event["session_id"], published[0]["session_id"])
+}
+
+// The failed ack is counted when exactly-once delivery is enabled, and the event is not counted as acked
+func TestEventHandlerAckFailed(t *testing.T) {
+	before := Stats()
+
+	fake := pubsubtest.NewService(pstest.WithErrorInjection("Acknowledge", codes.PermissionDenied, "ack denied"))
+	fake, msg := receiveFrom(t, fake, metrics.New)
+	assert.Equal(t, 0, msg.Acks)
+	assert.Len(t, fake.Published(metricsTopic), 1)
+	assert.Equal(t, before[AckFailed]+1, Stats()[AckFailed])
+	assert.Equal(t, before[Acked], Stats()[Acked])
+}
+
+// The event is acked without publishing if the factory consumes it without metrics
+func TestEventHandlerConsumed(t *testing.T) {
+	fake, msg := receive(t, func(map[string]interface{}, time.Time, time.Time, time.Duration, int) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	assert.Equal(t, 1, msg.Acks)
+	assert.Empty(t, fake.Published(metricsTopic))
+}
+
+// The event is nacked if the metrics factory fails
+func TestEventHandlerNack(t *testing.T) {
+	fake, msg := receive(t, func(map[string]interface{}, time.Time, time.Time, time.Duration, int) (map[string]interface{}, error) {
+		return nil, errors.New("factory error")
+	})
+	assert.Equal(t, 0, msg.Acks)
+	assert.True(t, nacked(msg))
+	assert.Empty(t, fake.Published(metricsTopic))
+}
+
+func usePublishFailurePolicy(t *testing.T, policy string) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.MetricsPublishFailurePolicy = policy
+	config.Config.MetricsPublishRetryInit = time.Millisecond
+	config.Config.MetricsPublishRetryMax = 10 * time.Millisecond
+}
+
+func failPublish(n int) func(*pubsubtest.Service) {
+	return func(fake *pubsubtest.Service) {
+		for i := 0; i < n; i++ {
+			fake.FailPublish(metricsTopic, errors.New("publish error"))
+		}
+	}
+}
+
+// The event is nacked if the metrics can not be published, and it is counted apart from the factory failures
+func TestEventHandlerPublishNack(t *testing.T) {
+	usePublishFailurePolicy(t, "nack")
+	before := Stats()
+
+	fake, msg := receive(t, metrics.New, failPublish(1))
+	assert.Equal(t, 0, msg.Acks)
+	assert.True(t, nacked(msg))
+	assert.Empty(t, fake.Published(metricsTopic))
+	assert.Equal(t, before[PublishFailed]+1, Stats()[PublishFailed])
+	assert.Equal(t, before[FactoryFailed], Stats()[FactoryFailed])
+}
+
+// The failed publish is retried with backoff before nacking the event
+func TestEventHandlerPublishRetry(t *testing.T) {
+	usePublishFailurePolicy(t, "retry")
+	before := Stats()
+
+	fake, msg := receive(t, metrics.New, failPublish(config.Config.MetricsPublishRetries))
+	assert.Equal(t, 1, msg.Acks)
+	assert.Len(t, fake.Published(metricsTopic), 1)
+	assert.Equal(t, before[PublishRetries]+int64(config.Config.MetricsPublishRetries), Stats()[PublishRetries])
+
+	fake, msg = receive(t, metrics.New, failPublish(config.Config.MetricsPublishRetries+1))
+	assert.True(t, nacked(msg))
+	assert.Empty(t, fake.Published(metricsTopic))
+}
+
+// The event is acked anyway in best-effort mode
+func TestEventHandlerPublishBestEffort(t *testing.T) {
+	usePublishFailurePolicy(t, "best-effort")
+	before := Stats()
+
+	fake, msg := receive(t, metrics.New, failPublish(1))
+	assert.Equal(t, 1, msg.Acks)
+	assert.Empty(t, fake.Published(metricsTopic))
+	assert.Equal(t, before[PublishDropped]+1, Stats()[PublishDropped])
+}
+
+// stubSink writes the metrics to memory or fails with err
+type stubSink struct {
+	name    string
+	err     error
+	written []map[string]interface{}
+}
+
+func (s *stubSink) Name() string { return s.name }
+
+func (s *stubSink) Write(_ context.Context, metrics map[string]interface{}) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	s.written = append(s.written, metrics)
+	return fmt.Sprint(len(s.written)), nil
+}
+
+func (s *stubSink) Close() error { return nil }
+
+// A failed sink does not stop writing the metrics to the other sinks
+func TestWriteMetrics(t *testing.T) {
+	usePublishFailurePolicy(t, "nack")
+	failed := &stubSink{name: "failed", err: errors.New("write error")}
+	ok := &stubSink{name: "ok"}
+	metrics := map[string]interface{}{"session_id": "1"}
+
+	ids, err := writeMetrics(context.Background(), []sink.Sink{failed, ok}, metrics)
+	assert.ErrorContains(t, err, "failed")
+	assert.Equal(t, map[string]string{"ok": "1"}, ids)
+	assert.Equal(t, []map[string]interface{}{metrics}, ok.written)
+}
+
+// The failed event is published to the error topic with the failure reason and then acked
+func TestEventHandlerDeadLetterPublish(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.DeadLetterPublish = true
+	before := Stats()
+
+	fake, msg := receive(t, func(map[string]interface{}, time.Time, time.Time, time.Duration, int) (map[string]interface{}, error) {
+		return nil, errors.New("factory error")
+	})
+	assert.Equal(t, 1, msg.Acks)
+	assert.False(t, nacked(msg))
+	assert.Empty(t, fake.Published(metricsTopic))
+	assert.Equal(t, before[FactoryFailed]+1, Stats()[FactoryFailed])
+	assert.Equal(t, before[DeadLettered]+1, Stats()[DeadLettered])
+
+	// The event and the dead lettered one
+	assert.Len(t, fake.Server.Messages(), 2)
+	for _, m := range fake.Server.Messages() {
+		if m.ID == msg.ID {
+			continue
+		}
+		assert.Equal(t, msg.Data, m.Data)
+		assert.Equal(t, "factory error", m.Attributes[ErrorAttribute])
+		assert.Equal(t, StageFactory, m.Attributes[StageAttribute])
+		assert.Equal(t, config.Config.Node, m.Attributes[NodeAttribute])
+		assert.Equal(t, msg.ID, m.Attributes[MessageIDAttribute])
+		_, err := time.Parse(time.RFC3339Nano, m.Attributes[TimestampAttribute])
+		assert.Nil(t, err)
+	}
+}
+
+// The event is nacked if it can not be published to the error topic
+func TestEventHandlerDeadLetterPublishError(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.DeadLetterPublish = true
+
+	fake, msg := receive(t, metrics.New, failPublish(1), func(fake *pubsubtest.Service) {
+		fake.FailPublish(config.Config.ErrorTopic, errors.New("publish error"))
+	})
+	assert.Equal(t, 0, msg.Acks)
+	assert.True(t, nacked(msg))
+	assert.Len(t, fake.Server.Messages(), 1)
+}
+
+// The failure reason longer than the attribute limit is truncated, so that the event is still dead lettered
+func TestEventHandlerDeadLetterPublishLongError(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.DeadLetterPublish = true
+	reason := strings.Repeat("é", pubsub.MaxAttributeValueSize)
+
+	fake, msg := receive(t, func(map[string]interface{}, time.Time, time.Time, time.Duration, int) (map[string]interface{}, error) {
+		return nil, errors.New(reason)
+	})
+	assert.Equal(t, 1, msg.Acks)
+	assert.False(t, nacked(msg))
+
+	assert.Len(t, fake.Server.Messages(), 2)
+	for _, m := range fake.Server.Messages() {
+		if m.ID == msg.ID {
+			continue
+		}
+		value := m.Attributes[ErrorAttribute]
+		assert.LessOrEqual(t, len(value), pubsub.MaxAttributeValueSize)
+		assert.True(t, utf8.ValidString(value))
+		assert.True(t, strings.HasSuffix(value, truncated))
+		assert.True(t, strings.HasPrefix(reason, strings.TrimSuffix(value, truncated)))
+	}
+}
+
+// receiveUndecodable publishes the data which is not an event to the fake event topic, and hands it to the given failure as Start does
+func receiveUndecodable(t *testing.T, fake *pubsubtest.Service, fail func(pubsub.Client) failure) *pstest.Message {
+	t.Cleanup(func() { fake.Close() }) // nolint: errcheck
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := fake.NewClient(ctx, nil)
+	assert.Nil(t, err)
+	defer client.Close() // nolint: errcheck
+	events := client.NewTopic(eventTopic, config.Config.EventCodec, pubsub.PublishSettings{})
+	defer events.Stop()
+	assert.Nil(t, client.CreateSubscriptionIfNotExists(ctx, eventSubscription, eventTopic, "", 0, true))
+	sub := client.NewSubscription(eventSubscription, config.Config.EventCodec, pubsub.ReceiveSettings{NumGoroutines: 1, MaxOutstandingMessages: 1})
+	id, err := events.PublishRaw(ctx, []byte("not an event"), nil)
+	assert.Nil(t, err)
+
+	var handled, returned atomic.Bool
+	decodeFail := fail(client)
+	sub.OnDecodeError(func(ctx context.Context, message *pubsub.Message, err error) {
+		if handled.CompareAndSwap(false, true) {
+			decodeFail(ctx, message, StageDecode, err)
+			returned.Store(true)
+		} else {
+			message.Nack() // nolint: errcheck
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sub.Receive(ctx, func(_ context.Context, message *pubsub.Message) { message.Nack() }) // nolint: errcheck
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	assert.Eventually(t, returned.Load, 5*time.Second, 10*time.Millisecond)
+	return fake.Server.Message(id)
+}
+
+// The undecodable event is rejected by the error topic enforcing the event schema, but published as is to the decode error topic without schema
+func TestEventHandlerDecodeError(t *testing.T) {
+	fake := pubsubtest.NewService()
+	fake.SetSchema(config.Config.ErrorTopic, config.Config.EventCodec)
+	msg := receiveUndecodable(t, fake, func(client pubsub.Client) failure {
+		topic := client.NewTopic(config.Config.ErrorTopic, config.Config.EventCodec, pubsub.PublishSettings{CountThreshold: 1})
+		t.Cleanup(topic.Stop)
+		return deadLetterFailure(topic)
+	})
+	assert.Equal(t, 0, msg.Acks)
+	assert.True(t, nacked(msg))
+	assert.Len(t, fake.Server.Messages(), 1)
+
+	fake = pubsubtest.NewService()
+	fake.SetSchema(config.Config.ErrorTopic, config.Config.EventCodec)
+	msg = receiveUndecodable(t, fake, func(client pubsub.Client) failure {
+		topic := client.NewTopic("DecodeErrorTopic", nil, pubsub.PublishSettings{CountThreshold: 1})
+		t.Cleanup(topic.Stop)
+		return deadLetterFailure(topic)
+	})
+	assert.Equal(t, 1, msg.Acks)
+	assert.False(t, nacked(msg))
+	assert.Len(t, fake.Server.Messages(), 2)
+	for _, m := range fake.Server.Messages() {
+		if m.ID != msg.ID {
+			assert.Equal(t, msg.Data, m.Data)
+			assert.Equal(t, StageDecode, m.Attributes[StageAttribute])
+		}
+	}
+}
+
+// The redelivered event is acked without publishing the metrics again, even after the processor restarts
+func TestEventHandlerDedupe(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.DedupeStore = "bolt"
+	config.Config.DedupePath = filepath.Join(t.TempDir(), "dedupe.db")
+	event := generator.NewEvent()
+	newEvent = func() map[string]interface{} { return event }
+	t.Cleanup(func() { newEvent = generator.NewEvent })
+	before := Stats()
+
+	fake, msg := receive(t, metrics.New)
+	assert.Equal(t, 1, msg.Acks)
+	assert.Len(t, fake.Published(metricsTopic), 1)
+
+	// The bolt store is reopened by the second receive
+	fake, msg = receive(t, metrics.New)
+	assert.Equal(t, 1, msg.Acks)
+	assert.Empty(t, fake.Published(metricsTopic))
+	assert.Equal(t, before[Duplicates]+1, Stats()[Duplicates])
+}
+
+// The invalid event is published to the quarantine topic with the violated rule and counted per rule
+func TestEventHandlerQuarantine(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.QuarantineTopic = "QuarantineTopic"
+	event := generator.NewEvent()
+	event["battery_level_start"] = float32(1.5)
+	newEvent = func() map[string]interface{} { return event }
+	t.Cleanup(func() { newEvent = generator.NewEvent })
+	before := Stats()
+
+	config.Config.MetricsMiddlewares = "quality"
+	quality, err := metrics.FromConfig(context.Background(), metrics.New)
+	assert.Nil(t, err)
+	fake, msg := receive(t, quality)
+	assert.Equal(t, 1, msg.Acks)
+	assert.Empty(t, fake.Published(metricsTopic))
+	assert.Equal(t, before[Invalid+"battery_level"]+1, Stats()[Invalid+"battery_level"])
+	assert.Equal(t, before[FactoryFailed], Stats()[FactoryFailed])
+
+	assert.Len(t, fake.Server.Messages(), 2)
+	for _, m := range fake.Server.Messages() {
+		if m.ID != msg.ID {
+			assert.Equal(t, msg.Data, m.Data)
+			assert.Equal(t, StageValidate, m.Attributes[StageAttribute])
+			assert.Equal(t, "battery_level", m.Attributes[RuleAttribute])
+		}
+	}
+}
+
+// useProcessingTimeout makes the simulated processing take 100ms and bounds the processing by the timeout
+func useProcessingTimeout(t *testing.T, timeout time.Duration, policy string) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.ProcessingTimeModel = "fixed"
+	config.Config.ProcessingTimeMin = 100 * time.Millisecond
+	config.Config.ProcessingTimeMax = 100 * time.Millisecond
+	config.Config.ProcessingTimeout = timeout
+	config.Config.ProcessingTimeoutPolicy = policy
+}
+
+// The event is nacked if the processing or the factory does not finish before the processing timeout
+func TestEventHandlerTimeout(t *testing.T) {
+	useProcessingTimeout(t, 50*time.Millisecond, "nack")
+	before := Stats()
+	fake, msg := receive(t, metrics.New)
+	assert.True(t, nacked(msg))
+	assert.Empty(t, fake.Published(metricsTopic))
+	assert.Equal(t, before[TimedOut]+1, Stats()[TimedOut])
+
+	// The stuck factory is abandoned when the timeout is reached
+	useProcessingTimeout(t, 300*time.Millisecond, "nack")
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	stuck := func(map[string]interface{}, time.Time, time.Time, time.Duration, int) (map[string]interface{}, error) {
+		<-release
+		return nil, nil
+	}
+	started := time.Now()
+	fake, msg = receive(t, stuck)
+	assert.Less(t, time.Since(started), 5*time.Second)
+	assert.True(t, nacked(msg))
+	assert.Equal(t, before[TimedOut]+2, Stats()[TimedOut])
+	assert.Equal(t, before[FactoryFailed], Stats()[FactoryFailed])
+
+	// The event processed in time is acked
+	fake, msg = receive(t, metrics.New)
+	assert.Equal(t, 1, msg.Acks)
+	assert.Len(t, fake.Published(metricsTopic), 1)
+}
+
+// The timed out event is published to the error topic by the dead-letter policy
+func TestEventHandlerTimeoutDeadLetter(t *testing.T) {
+	useProcessingTimeout(t, 50*time.Millisecond, "dead-letter")
+	fake, msg := receive(t, metrics.New)
+	assert.Equal(t, 1, msg.Acks)
+	assert.Len(t, fake.Server.Messages(), 2)
+	for _, m := range fake.Server.Messages() {
+		if m.ID != msg.ID {
+			assert.Equal(t, msg.Data, m.Data)
+			assert.Equal(t, StageTimeout, m.Attributes[StageAttribute])
+		}
+	}
+}
+
+// The factory gets a copy of the event, so that the abandoned factory changing it does not change the event being dead lettered
+func TestCallFactoryCopy(t *testing.T) {
+	message := &pubsub.Message{Message: &gpubsub.Message{}, Data: map[string]interface{}{"session_id": "1"}}
+	release := make(chan struct{})
+	done := make(chan struct{})
+	enrich := func(event map[string]interface{}, _ time.Time, _ time.Time, _ time.Duration, _ int) (map[string]interface{}, error) {
+		defer close(done)
+		<-release
+		event["session_id"] = "changed"
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := callFactory(ctx, enrich, message, time.Now(), 0)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	close(release)
+	<-done
+	assert.Equal(t, map[string]interface{}{"session_id": "1"}, message.Data)
+}
+
+// The handler continues the trace of the event, and the metrics message carries the trace context
+func TestEventHandlerTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+
+	fake, msg := receive(t, metrics.New)
+	assert.Equal(t, 1, msg.Acks)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	event := spans["publish event"]
+	assert.NotNil(t, event)
+	receive := spans[eventSubscription+" receive"]
+	assert.NotNil(t, receive)
+	assert.Equal(t, event.SpanContext().SpanID(), receive.Parent().SpanID())
+	for _, name := range []string{"decode", "processing", "factory", metricsTopic + " publish"} {
+		assert.Contains(t, spans, name)
+		assert.Equal(t, receive.SpanContext().SpanID(), spans[name].Parent().SpanID())
+	}
+
+	// The metrics message is the only message other than the event
+	assert.Len(t, fake.Server.Messages(), 2)
+	for _, m := range fake.Server.Messages() {
+		if m.ID != msg.ID {
+			traceID := event.SpanContext().TraceID().String()
+			assert.Contains(t, m.Attributes["traceparent"], traceID)
+		}
+	}
+}
+
+// The processor stops if the subscription does not exist
+func TestStartPermanentError(t *testing.T) {
+	fake := pubsubtest.NewService()
+	pubsub.Service = fake
+	t.Cleanup(func() { fake.Close() }) // nolint: errcheck
+
+	err := Start(context.Background(), metrics.New)
+	assert.NotNil(t, err)
+	assert.True(t, pubsub.IsPermanent(err))
+}
+
+// The transient errors are retried with backoff until the context is done
+func TestReceiveLoopTransientError(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.SubscriberRetryInit = 10 * time.Millisecond
+	config.Config.SubscriberRetryMax = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	restarted := Stats()[Restarts]
+	var calls int
+	err := receiveLoop(ctx, eventSubscription, func(context.Context) error {
+		calls++
+		if calls == 3 {
+			cancel()
+			<-ctx.Done()
+		}
+		return status.Error(codes.Unavailable, "unavailable")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, restarted+2, Stats()[Restarts])
+}
+
+// The permanent errors are not retried
+func TestReceiveLoopPermanentError(t *testing.T) {
+	var calls int
+	err := receiveLoop(context.Background(), eventSubscription, func(context.Context) error {
+		calls++
+		return fmt.Errorf("wrapped: %w", status.Error(codes.PermissionDenied, "permission denied"))
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+}
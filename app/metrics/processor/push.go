@@ -0,0 +1,71 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"context"
+	"fmt"
+	"google/jss/pubsub-integration/logging"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/pubsub"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// pushShutdownTimeout is the time to wait for the push requests being handled when the context is done
+const pushShutdownTimeout = 10 * time.Second
+
+// pushConfig creates the settings of the push endpoint, the OIDC token is verified if PUSH_AUDIENCE is set
+func pushConfig() pubsub.PushConfig {
+	cfg := pubsub.PushConfig{Unwrapped: config.Config.PushUnwrapped}
+	if config.Config.PushAudience != "" {
+		cfg.Verify = pubsub.NewTokenVerifier(config.Config.PushAudience, config.Config.PushServiceAccount)
+	}
+	return cfg
+}
+
+// servePush serves the push subscription by HTTP until the context is done.
+// The pushed event is handled by the same handler as the pulled one, and its ack or nack is the response status.
+func servePush(ctx context.Context, sub *pubsub.Subscription, handler pubsub.MessageHandler) error {
+	sub.SetAckDeadline(config.Config.PushAckDeadline)
+	sub.SetLeaseLimit(config.Config.PushAckDeadline)
+	mux := http.NewServeMux()
+	mux.Handle(config.Config.PushPath, sub.PushHandler(pushConfig(), handler))
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%v", config.Config.PushPort),
+		Handler:           mux,
+		ReadHeaderTimeout: pushShutdownTimeout,
+	}
+	slog.Info("serving push subscription", logging.Subscription, sub.ID, "addr", server.Addr, "path", config.Config.PushPath, "unwrapped", config.Config.PushUnwrapped)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("fail to serve push subscription: %v, err: %w", sub.ID, err)
+	case <-ctx.Done():
+	}
+
+	// Wait for the events being handled, so that they are not handled after the sinks are closed
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), pushShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("fail to shutdown push server", "err", err)
+	}
+	slog.Info("context done, push server stopped")
+	return nil
+}
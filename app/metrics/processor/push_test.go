@@ -0,0 +1,168 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/metrics/sink"
+	"google/jss/pubsub-integration/pubsub"
+	"google/jss/pubsub-integration/pubsub/pubsubtest"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pushServer serves the push subscription with the event handler of the given factory, the metrics are published to the fake metrics topic
+func pushServer(t *testing.T, cfg pubsub.PushConfig, factory metrics.Factory) (*pubsubtest.Service, *httptest.Server) {
+	fake := pubsubtest.NewService()
+	t.Cleanup(func() { fake.Close() }) // nolint: errcheck
+	client, err := fake.NewClient(context.Background(), nil)
+	assert.Nil(t, err)
+	t.Cleanup(func() { client.Close() }) // nolint: errcheck
+
+	sub := client.NewSubscription(eventSubscription, config.Config.EventCodec, pubsub.ReceiveSettings{NumGoroutines: 1, MaxOutstandingMessages: 1})
+	topic := client.NewTopic(metricsTopic, config.Config.MetricsCodec, pubsub.PublishSettings{CountThreshold: 1})
+	t.Cleanup(topic.Stop)
+	handler := eventHandler([]sink.Sink{sink.NewTopic(topic)}, factory, nackFailure, nackFailure, nackFailure, nil)
+	server := httptest.NewServer(sub.PushHandler(cfg, handler))
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+// wrappedRequest creates the JSON body of the wrapped push request of the event
+func wrappedRequest(t *testing.T, deliveryAttempt int) []byte {
+	data, err := avro.EncodeToJSON(config.Config.EventCodec, newEvent())
+	assert.Nil(t, err)
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"data":        data,
+			"attributes":  map[string]string{"key": "value"},
+			"messageId":   "1",
+			"publishTime": time.Now().Format(time.RFC3339Nano),
+		},
+		"subscription":    "projects/test/subscriptions/" + eventSubscription,
+		"deliveryAttempt": deliveryAttempt,
+	})
+	assert.Nil(t, err)
+	return body
+}
+
+func push(t *testing.T, server *httptest.Server, body []byte, header http.Header) int {
+	req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(body))
+	assert.Nil(t, err)
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close() // nolint: errcheck
+	return resp.StatusCode
+}
+
+// The acked event is responded with 2xx and the nacked one with non-2xx
+func TestPushWrapped(t *testing.T) {
+	fake, server := pushServer(t, pubsub.PushConfig{}, metrics.New)
+	assert.Equal(t, http.StatusNoContent, push(t, server, wrappedRequest(t, 3), nil))
+	published := fake.Published(metricsTopic)
+	assert.Len(t, published, 1)
+	assert.Equal(t, map[string]interface{}{"int": int32(3)}, published[0]["delivery_attempt"])
+
+	fake, server = pushServer(t, pubsub.PushConfig{}, func(map[string]interface{}, time.Time, time.Time, time.Duration, int) (map[string]interface{}, error) {
+		return nil, errors.New("factory error")
+	})
+	assert.Equal(t, http.StatusInternalServerError, push(t, server, wrappedRequest(t, 1), nil))
+	assert.Empty(t, fake.Published(metricsTopic))
+
+	assert.Equal(t, http.StatusBadRequest, push(t, server, []byte("not json"), nil))
+	resp, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+// The unwrapped request body is the event, and the metadata is in the headers
+func TestPushUnwrapped(t *testing.T) {
+	fake, server := pushServer(t, pubsub.PushConfig{Unwrapped: true}, metrics.New)
+	data, err := avro.EncodeToJSON(config.Config.EventCodec, newEvent())
+	assert.Nil(t, err)
+	header := http.Header{}
+	header.Set("X-Goog-Pubsub-Message-Id", "1")
+	header.Set("X-Goog-Pubsub-Publish-Time", time.Now().Format(time.RFC3339Nano))
+	assert.Equal(t, http.StatusNoContent, push(t, server, data, header))
+	assert.Len(t, fake.Published(metricsTopic), 1)
+
+	header.Set("X-Goog-Pubsub-Publish-Time", "yesterday")
+	assert.Equal(t, http.StatusBadRequest, push(t, server, data, header))
+}
+
+// The request without a valid OIDC token is rejected before handling the event
+func TestPushVerifyToken(t *testing.T) {
+	verify := func(_ context.Context, token string) error {
+		if token != "valid" {
+			return errors.New("invalid token")
+		}
+		return nil
+	}
+	fake, server := pushServer(t, pubsub.PushConfig{Verify: verify}, metrics.New)
+	assert.Equal(t, http.StatusUnauthorized, push(t, server, wrappedRequest(t, 1), nil))
+	assert.Equal(t, http.StatusUnauthorized, push(t, server, wrappedRequest(t, 1), http.Header{"Authorization": {"Bearer invalid"}}))
+	assert.Empty(t, fake.Published(metricsTopic))
+	assert.Equal(t, http.StatusNoContent, push(t, server, wrappedRequest(t, 1), http.Header{"Authorization": {"Bearer valid"}}))
+	assert.Len(t, fake.Published(metricsTopic), 1)
+}
+
+// The concurrent redeliveries of the same event publish the metrics once with the dedupe store
+func TestPushDedupeConcurrent(t *testing.T) {
+	fake := pubsubtest.NewService()
+	t.Cleanup(func() { fake.Close() }) // nolint: errcheck
+	client, err := fake.NewClient(context.Background(), nil)
+	assert.Nil(t, err)
+	t.Cleanup(func() { client.Close() }) // nolint: errcheck
+	sub := client.NewSubscription(eventSubscription, config.Config.EventCodec, pubsub.ReceiveSettings{})
+	topic := client.NewTopic(metricsTopic, config.Config.MetricsCodec, pubsub.PublishSettings{CountThreshold: 1})
+	t.Cleanup(topic.Stop)
+	before := Stats()
+
+	// The factory is slow, so that both deliveries are in flight at the same time
+	factory := func(event map[string]interface{}, publishTime time.Time, ackTime time.Time, processingTime time.Duration, deliveryAttempt int) (map[string]interface{}, error) {
+		time.Sleep(100 * time.Millisecond)
+		return metrics.New(event, publishTime, ackTime, processingTime, deliveryAttempt)
+	}
+	handler := eventHandler([]sink.Sink{sink.NewTopic(topic)}, factory, nackFailure, nackFailure, nackFailure, newMemoryStore(10, time.Hour))
+	server := httptest.NewServer(sub.PushHandler(pubsub.PushConfig{}, handler))
+	t.Cleanup(server.Close)
+
+	body := wrappedRequest(t, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, http.StatusNoContent, push(t, server, body, nil))
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, fake.Published(metricsTopic), 1)
+	assert.Equal(t, before[Duplicates]+1, Stats()[Duplicates])
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processor
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// The names of the counters
+const (
+	Restarts       = "restarts"        // the subscriber is restarted after receive errors
+	Acked          = "acked"           // the event is acked
+	AckFailed      = "ack_failed"      // the ack of the event fails with exactly-once delivery
+	NackFailed     = "nack_failed"     // the nack of the event fails with exactly-once delivery
+	DecodeFailed   = "decode_failed"   // the event can not be decoded
+	FactoryFailed  = "factory_failed"  // the metrics factory fails
+	PublishFailed  = "publish_failed"  // the metrics can not be published
+	DeadLettered   = "dead_lettered"   // the failed event is published to the error topic and acked
+	PublishDropped = "publish_dropped" // the metrics can not be published but the event is acked in best-effort mode
+	PublishRetries = "publish_retries" // the metrics publish is retried
+	Duplicates     = "duplicates"      // the duplicate event is acked without publishing metrics
+	TimedOut       = "timed_out"       // the processing of the event does not finish before the processing timeout or the lease deadline
+	Invalid        = "invalid_"        // the prefix of the counters of the invalid events per validation rule
+	ClampedLevel   = "clamped_level"   // the battery_level_end of the complete metrics is clamped at 1
+)
+
+var statsMux sync.Mutex
+var stats = map[string]int64{}
+
+// gauges are the counters maintained outside the processor keyed by name, e.g. by the metrics factories and middlewares
+var gauges = map[string]func() int64{}
+
+// RegisterStat adds the counter maintained outside the processor to the stats, it is reported if it is not zero
+func RegisterStat(name string, value func() int64) {
+	statsMux.Lock()
+	defer statsMux.Unlock()
+	gauges[name] = value
+}
+
+// count increases the counter and returns the new value
+func count(name string) int64 {
+	statsMux.Lock()
+	defer statsMux.Unlock()
+	stats[name]++
+	return stats[name]
+}
+
+// Stats returns the snapshot of the counters keyed by name
+func Stats() map[string]int64 {
+	statsMux.Lock()
+	defer statsMux.Unlock()
+	snapshot := make(map[string]int64, len(stats))
+	for name, n := range stats {
+		snapshot[name] = n
+	}
+	for name, value := range gauges {
+		if n := value(); n > 0 {
+			snapshot[name] = n
+		}
+	}
+	return snapshot
+}
+
+// reportStats logs the counters every interval until the context is done
+func reportStats(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			attrs := []any{}
+			for name, n := range Stats() {
+				attrs = append(attrs, name, n)
+			}
+			slog.Info("processor stats", slog.Group("stats", attrs...))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quality validates the semantics of events with the built-in EV rules, e.g. the battery level is between 0 and 1.
+//
+// The overcharge rule is not checked by default, since most generated events charge more than the remaining battery capacity.
+// The complete metrics clamps the battery level of such events at 1 and counts them instead.
+package quality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"strings"
+	"time"
+)
+
+// Rule checks an event, it returns the error describing the violation
+type Rule func(event map[string]interface{}) error
+
+// Rules are the built-in rules keyed by name, the bounds are given by config
+var Rules = map[string]Rule{
+	"session_order":    sessionOrder,
+	"battery_level":    batteryLevel,
+	"charge_rate":      chargeRate,
+	"battery_capacity": batteryCapacity,
+	"session_duration": sessionDuration,
+	"overcharge":       overcharge,
+}
+
+func init() {
+	metrics.Register("quality", func(context.Context) (metrics.Middleware, error) {
+		return Middleware(config.Config.QualityRules)
+	})
+}
+
+// Middleware validates the event with the comma separated list of rules in order, the first violation fails the event with metrics.InvalidEventError
+func Middleware(rules string) (metrics.Middleware, error) {
+	var chain []metrics.Middleware
+	for _, name := range strings.Split(rules, ",") {
+		name = strings.TrimSpace(name)
+		rule, ok := Rules[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown quality rule: %v", name)
+		}
+		chain = append(chain, metrics.Validate(name, rule))
+	}
+	return func(next metrics.Factory) metrics.Factory {
+		return metrics.Chain(next, chain...)
+	}, nil
+}
+
+func sessionOrder(event map[string]interface{}) error {
+	start, end, err := sessionTimes(event)
+	if err != nil {
+		return err
+	}
+	if !end.After(start) {
+		return fmt.Errorf("session_end_time %v is not after session_start_time %v", end, start)
+	}
+	return nil
+}
+
+func batteryLevel(event map[string]interface{}) error {
+	level, err := avro.GetValue(event, "battery_level_start", float32(0))
+	if err != nil {
+		return err
+	}
+	if level < 0 || level > 1 {
+		return fmt.Errorf("battery_level_start %v is not between 0 and 1", level)
+	}
+	return nil
+}
+
+func chargeRate(event map[string]interface{}) error {
+	rate, err := avro.GetValue(event, "avg_charge_rate_kw", float32(0))
+	if err != nil {
+		return err
+	}
+	if rate <= 0 || float64(rate) > config.Config.QualityMaxChargeRate {
+		return fmt.Errorf("avg_charge_rate_kw %v is not between 0 and %v", rate, config.Config.QualityMaxChargeRate)
+	}
+	return nil
+}
+
+func batteryCapacity(event map[string]interface{}) error {
+	capacity, err := avro.GetValue(event, "battery_capacity_kwh", float32(0))
+	if err != nil {
+		return err
+	}
+	if float64(capacity) < config.Config.QualityMinBatteryCapacity || float64(capacity) > config.Config.QualityMaxBatteryCapacity {
+		return fmt.Errorf("battery_capacity_kwh %v is not between %v and %v", capacity, config.Config.QualityMinBatteryCapacity, config.Config.QualityMaxBatteryCapacity)
+	}
+	return nil
+}
+
+func sessionDuration(event map[string]interface{}) error {
+	start, end, err := sessionTimes(event)
+	if err != nil {
+		return err
+	}
+	if end.Sub(start) > config.Config.QualityMaxSessionDuration {
+		return fmt.Errorf("session duration %v is longer than %v", end.Sub(start), config.Config.QualityMaxSessionDuration)
+	}
+	return nil
+}
+
+// overcharge checks the energy charged at the average rate fits the remaining battery capacity, otherwise the complete metrics has to clamp the battery level at 1
+func overcharge(event map[string]interface{}) error {
+	start, end, err := sessionTimes(event)
+	if err != nil {
+		return err
+	}
+	rate, err := avro.GetValue(event, "avg_charge_rate_kw", float32(0))
+	if err != nil {
+		return err
+	}
+	capacity, err := avro.GetValue(event, "battery_capacity_kwh", float32(0))
+	if err != nil {
+		return err
+	}
+	level, err := avro.GetValue(event, "battery_level_start", float32(0))
+	if err != nil {
+		return err
+	}
+	charged := float64(rate) * end.Sub(start).Hours()
+	remaining := float64(1-level) * float64(capacity)
+	if charged > remaining*(1+config.Config.QualityOverchargeTolerance) {
+		return fmt.Errorf("charged %.1f kWh exceeds the remaining battery capacity %.1f kWh", charged, remaining)
+	}
+	return nil
+}
+
+func sessionTimes(event map[string]interface{}) (time.Time, time.Time, error) {
+	start, err := avro.GetValue(event, "session_start_time", time.Time{})
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := avro.GetValue(event, "session_end_time", time.Time{})
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if start.IsZero() || end.IsZero() {
+		return time.Time{}, time.Time{}, errors.New("session time is missing")
+	}
+	return start, end, nil
+}
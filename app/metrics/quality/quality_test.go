@@ -0,0 +1,81 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quality
+
+import (
+	"google/jss/pubsub-integration/eventgen/generator"
+	"google/jss/pubsub-integration/metrics"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The generated events pass the default rules
+func TestRulesValid(t *testing.T) {
+	for name, rule := range Rules {
+		if name == "overcharge" {
+			continue // the generator does not keep the charged energy within the battery capacity
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, rule(generator.NewEvent()), name)
+		}
+	}
+}
+
+func TestRulesInvalid(t *testing.T) {
+	tests := map[string]func(map[string]interface{}){
+		"session_order": func(e map[string]interface{}) { e["session_start_time"] = e["session_end_time"] },
+		"battery_level": func(e map[string]interface{}) { e["battery_level_start"] = float32(-0.1) },
+		"charge_rate":   func(e map[string]interface{}) { e["avg_charge_rate_kw"] = float32(1000) },
+		"battery_capacity": func(e map[string]interface{}) {
+			e["battery_capacity_kwh"] = float32(5)
+		},
+		"session_duration": func(e map[string]interface{}) {
+			e["session_start_time"] = e["session_end_time"].(time.Time).Add(-48 * time.Hour)
+		},
+		"overcharge": func(e map[string]interface{}) {
+			e["session_start_time"] = e["session_end_time"].(time.Time).Add(-time.Hour)
+			e["avg_charge_rate_kw"] = float32(100)
+			e["battery_capacity_kwh"] = float32(50)
+		},
+	}
+	for name, invalidate := range tests {
+		event := generator.NewEvent()
+		invalidate(event)
+		assert.NotNil(t, Rules[name](event), name)
+	}
+}
+
+// The first violated rule fails the event with InvalidEventError
+func TestMiddleware(t *testing.T) {
+	middleware, err := Middleware("session_order, battery_level")
+	assert.Nil(t, err)
+	factory := metrics.Chain(metrics.New, middleware)
+
+	event := generator.NewEvent()
+	m, err := factory(event, time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, m)
+
+	event["battery_level_start"] = float32(2)
+	_, err = factory(event, time.Now(), time.Now(), 0, 0)
+	var invalid *metrics.InvalidEventError
+	assert.ErrorAs(t, err, &invalid)
+	assert.Equal(t, "battery_level", invalid.Rule)
+
+	_, err = Middleware("unknown")
+	assert.NotNil(t, err)
+}
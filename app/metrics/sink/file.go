@@ -0,0 +1,187 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google/jss/pubsub-integration/metrics/config"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// The formats of the file sink, they are also the file extensions
+const (
+	FormatOCF     = "ocf"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// inProgress is the suffix of the file being written, it is removed when the file is rotated or the sink is closed
+const inProgress = ".inprogress"
+
+// recordWriter writes the metrics to a file of a format
+type recordWriter interface {
+	Write(map[string]interface{}) error
+	Close() error // flushes the buffered metrics and writes the footer if any, it does not close the file
+}
+
+type fileSink struct {
+	mux          sync.Mutex
+	dir          string
+	format       string
+	codec        *goavro.Codec
+	columns      []column // the flat columns of the metrics schema, only used by csv and parquet
+	interval     time.Duration
+	maxRecords   int
+	blockRecords int
+
+	file    *os.File // the current file, nil until the first metrics is written after it is opened or rotated
+	writer  recordWriter
+	opened  time.Time
+	records int
+	timer   *time.Timer // rotates the current file after interval even if no more metrics is written
+}
+
+// NewFile creates the sink writing the metrics to the files in dir.
+// The file is rotated after interval or maxRecords metrics, 0 to disable either of them.
+// The ocf and parquet files buffer blockRecords metrics per block or row group, the buffered metrics are written when the file is rotated or the sink is closed.
+// The file being written has the .inprogress suffix, so only the complete files have the format extension.
+func NewFile(dir string, format string, codec *goavro.Codec, interval time.Duration, maxRecords int, blockRecords int) (Sink, error) {
+	if blockRecords < 1 {
+		blockRecords = 1
+	}
+	s := &fileSink{dir: dir, format: format, codec: codec, interval: interval, maxRecords: maxRecords, blockRecords: blockRecords}
+	switch format {
+	case FormatOCF:
+	case FormatCSV, FormatParquet:
+		columns, err := columnsOf(codec)
+		if err != nil {
+			return nil, err
+		}
+		s.columns = columns
+	default:
+		return nil, fmt.Errorf("unknown file format: %v, ocf, csv or parquet is expected", format)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("fail to create metrics file directory: %v, err: %w", dir, err)
+	}
+	return s, nil
+}
+
+func (s *fileSink) Name() string {
+	return s.format + " file"
+}
+
+// Write writes the metrics to the current file and returns its name
+func (s *fileSink) Write(_ context.Context, metrics map[string]interface{}) (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := time.Now()
+	if s.file != nil && ((s.interval > 0 && now.Sub(s.opened) >= s.interval) || (s.maxRecords > 0 && s.records >= s.maxRecords)) {
+		if err := s.rotate(); err != nil {
+			return "", err
+		}
+	}
+	if s.file == nil {
+		if err := s.open(now); err != nil {
+			return "", err
+		}
+	}
+	if err := s.writer.Write(metrics); err != nil {
+		return "", fmt.Errorf("fail to write metrics to file: %v, err: %w", s.file.Name(), err)
+	}
+	s.records++
+	return filepath.Base(s.path()), nil
+}
+
+// Close completes the current file
+func (s *fileSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.rotate()
+}
+
+// path is the name of the current file after it is completed
+func (s *fileSink) path() string {
+	return s.file.Name()[:len(s.file.Name())-len(inProgress)]
+}
+
+func (s *fileSink) open(now time.Time) error {
+	name := fmt.Sprintf("metrics-%v-%v.%v", config.Config.Node, now.UTC().Format("20060102T150405.000000000Z"), s.format)
+	file, err := os.Create(filepath.Join(s.dir, name+inProgress))
+	if err != nil {
+		return fmt.Errorf("fail to create metrics file: %v, err: %w", name, err)
+	}
+	var writer recordWriter
+	switch s.format {
+	case FormatOCF:
+		writer, err = newOCFWriter(file, s.codec, s.blockRecords)
+	case FormatCSV:
+		writer, err = newCSVWriter(file, s.columns)
+	case FormatParquet:
+		writer, err = newParquetWriter(file, s.columns, s.blockRecords)
+	}
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return fmt.Errorf("fail to create %v writer, err: %w", s.format, err)
+	}
+	s.file, s.writer, s.opened, s.records = file, writer, now, 0
+	if s.interval > 0 {
+		s.timer = time.AfterFunc(s.interval, func() { s.expire(file) })
+	}
+	slog.Info("metrics file opened", "file", file.Name())
+	return nil
+}
+
+// expire rotates the file if it is still the current one, so that the idle sink completes the file after interval as well
+func (s *fileSink) expire(file *os.File) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.file != file {
+		return
+	}
+	if err := s.rotate(); err != nil {
+		slog.Error("fail to rotate metrics file", "err", err)
+	}
+}
+
+// rotate completes the current file if any, the next Write opens a new file
+func (s *fileSink) rotate() error {
+	if s.file == nil {
+		return nil
+	}
+	file, writer, path := s.file, s.writer, s.path()
+	s.file, s.writer = nil, nil
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if err := errors.Join(writer.Close(), file.Close()); err != nil {
+		return fmt.Errorf("fail to complete metrics file: %v, err: %w", file.Name(), err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("fail to rename metrics file: %v, err: %w", file.Name(), err)
+	}
+	slog.Info("metrics file completed", "file", path, "records", s.records)
+	return nil
+}
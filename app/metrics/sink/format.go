@@ -0,0 +1,275 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// column is a field of the flat metrics schema
+type column struct {
+	name     string
+	avroType string // the primitive type, or type.logicalType, e.g. long.timestamp-micros
+	nullable bool   // the field is the union of null and the type
+}
+
+// parquetTypes are the parquet column metadata of the avro types
+var parquetTypes = map[string]string{
+	"boolean":               "type=BOOLEAN",
+	"int":                   "type=INT32",
+	"long":                  "type=INT64",
+	"float":                 "type=FLOAT",
+	"double":                "type=DOUBLE",
+	"string":                "type=BYTE_ARRAY, convertedtype=UTF8",
+	"bytes":                 "type=BYTE_ARRAY",
+	"int.date":              "type=INT32, convertedtype=DATE",
+	"long.timestamp-millis": "type=INT64, convertedtype=TIMESTAMP_MILLIS",
+	"long.timestamp-micros": "type=INT64, convertedtype=TIMESTAMP_MICROS",
+}
+
+// columnsOf returns the columns of the record schema of the codec, the fields must be the primitive types or the optional ones
+func columnsOf(codec *goavro.Codec) ([]column, error) {
+	var schema struct {
+		Type   string `json:"type"`
+		Fields []struct {
+			Name string      `json:"name"`
+			Type interface{} `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(codec.Schema()), &schema); err != nil || schema.Type != "record" {
+		return nil, fmt.Errorf("the metrics schema must be a record")
+	}
+	columns := make([]column, len(schema.Fields))
+	for i, field := range schema.Fields {
+		c := column{name: field.Name}
+		fieldType := field.Type
+		if branches, ok := fieldType.([]interface{}); ok && len(branches) == 2 && branches[0] == "null" {
+			c.nullable = true
+			fieldType = branches[1]
+		}
+		switch t := fieldType.(type) {
+		case string:
+			c.avroType = t
+		case map[string]interface{}:
+			c.avroType = fmt.Sprint(t["type"])
+			if logical, ok := t["logicalType"]; ok {
+				c.avroType += "." + fmt.Sprint(logical)
+			}
+		}
+		if _, ok := parquetTypes[c.avroType]; !ok {
+			return nil, fmt.Errorf("the type of field %v is not supported by the file sink: %v", field.Name, field.Type)
+		}
+		columns[i] = c
+	}
+	return columns, nil
+}
+
+// unwrap returns the value of the union, e.g. 1.5 of {"float": 1.5}
+func unwrap(value interface{}) interface{} {
+	if union, ok := value.(map[string]interface{}); ok && len(union) == 1 {
+		for _, v := range union {
+			return v
+		}
+	}
+	return value
+}
+
+type ocfWriter struct {
+	ocf          *goavro.OCFWriter
+	blockRecords int
+	block        []interface{}
+}
+
+func newOCFWriter(w io.Writer, codec *goavro.Codec, blockRecords int) (recordWriter, error) {
+	ocf, err := goavro.NewOCFWriter(goavro.OCFConfig{W: w, Codec: codec})
+	if err != nil {
+		return nil, err
+	}
+	return &ocfWriter{ocf: ocf, blockRecords: blockRecords}, nil
+}
+
+// Write buffers the metrics and appends them as a block once there are blockRecords of them
+func (w *ocfWriter) Write(metrics map[string]interface{}) error {
+	w.block = append(w.block, metrics)
+	if len(w.block) < w.blockRecords {
+		return nil
+	}
+	return w.flush()
+}
+
+// Close appends the buffered metrics as the last block
+func (w *ocfWriter) Close() error {
+	return w.flush()
+}
+
+func (w *ocfWriter) flush() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	block := w.block
+	w.block = nil
+	return w.ocf.Append(block)
+}
+
+type csvWriter struct {
+	csv     *csv.Writer
+	columns []column
+}
+
+// newCSVWriter writes the header of the column names
+func newCSVWriter(w io.Writer, columns []column) (recordWriter, error) {
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.name
+	}
+	cw := &csvWriter{csv: csv.NewWriter(w), columns: columns}
+	if err := cw.csv.Write(header); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Write writes a row, the null value is empty and the timestamp is RFC 3339
+func (w *csvWriter) Write(metrics map[string]interface{}) error {
+	row := make([]string, len(w.columns))
+	for i, c := range w.columns {
+		switch v := unwrap(metrics[c.name]).(type) {
+		case nil:
+		case time.Time:
+			row[i] = v.UTC().Format(time.RFC3339Nano)
+		case float32:
+			row[i] = strconv.FormatFloat(float64(v), 'g', -1, 32)
+		case float64:
+			row[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		case []byte:
+			row[i] = string(v)
+		default:
+			row[i] = fmt.Sprint(v)
+		}
+	}
+	if err := w.csv.Write(row); err != nil {
+		return err
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+func (w *csvWriter) Close() error {
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+type parquetWriter struct {
+	parquet      *writer.CSVWriter
+	columns      []column
+	rowGroupRows int
+	rows         int // the rows of the current row group
+}
+
+func newParquetWriter(w io.Writer, columns []column, rowGroupRows int) (recordWriter, error) {
+	metadata := make([]string, len(columns))
+	for i, c := range columns {
+		metadata[i] = fmt.Sprintf("name=%v, %v", c.name, parquetTypes[c.avroType])
+		if c.nullable {
+			metadata[i] += ", repetitiontype=OPTIONAL"
+		}
+	}
+	pw, err := writer.NewCSVWriterFromWriter(metadata, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetWriter{parquet: pw, columns: columns, rowGroupRows: rowGroupRows}, nil
+}
+
+// Write buffers a row and writes the row group once there are rowGroupRows rows
+func (w *parquetWriter) Write(metrics map[string]interface{}) error {
+	row := make([]interface{}, len(w.columns))
+	for i, c := range w.columns {
+		value, err := parquetValue(c, unwrap(metrics[c.name]))
+		if err != nil {
+			return err
+		}
+		row[i] = value
+	}
+	if err := w.parquet.Write(row); err != nil {
+		return err
+	}
+	w.rows++
+	if w.rows < w.rowGroupRows {
+		return nil
+	}
+	w.rows = 0
+	return w.parquet.Flush(true)
+}
+
+// Close writes the buffered rows as the last row group and the footer
+func (w *parquetWriter) Close() error {
+	return w.parquet.WriteStop()
+}
+
+// parquetValue converts the avro native value to the go type of the parquet column
+func parquetValue(c column, value interface{}) (interface{}, error) {
+	if value == nil {
+		if !c.nullable {
+			return nil, fmt.Errorf("the value of field %v is missing", c.name)
+		}
+		return nil, nil
+	}
+	switch c.avroType {
+	case "long.timestamp-millis", "long.timestamp-micros", "int.date":
+		if t, ok := value.(time.Time); ok {
+			switch c.avroType {
+			case "long.timestamp-millis":
+				return t.UnixMilli(), nil
+			case "long.timestamp-micros":
+				return t.UnixMicro(), nil
+			default:
+				return int32(t.Unix() / 86400), nil
+			}
+		}
+	}
+	switch v := value.(type) {
+	case bool, string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int, int32, int64:
+		n := reflect.ValueOf(v).Int()
+		switch c.avroType {
+		case "int", "int.date":
+			return int32(n), nil
+		case "long", "long.timestamp-millis", "long.timestamp-micros":
+			return n, nil
+		}
+	case float32, float64:
+		f := reflect.ValueOf(v).Float()
+		switch c.avroType {
+		case "float":
+			return float32(f), nil
+		case "double":
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("the value of field %v is %T, but %v is expected", c.name, value, c.avroType)
+}
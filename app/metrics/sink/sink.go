@@ -0,0 +1,140 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sink writes the metrics to their destinations, e.g. the metrics topic, local files and stdout
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/pubsub"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// Sink is a destination of the metrics
+type Sink interface {
+	Name() string
+	Write(context.Context, map[string]interface{}) (string, error) // returns the ID of the written metrics, e.g. the message ID or the file name
+	Close() error
+}
+
+// FromConfig creates the sinks given by METRICS_SINKS, newTopic is only called if the pubsub sink is enabled
+func FromConfig(newTopic func() pubsub.Topic) ([]Sink, error) {
+	var sinks []Sink
+	names := map[string]bool{}
+	for _, name := range strings.Split(config.Config.MetricsSinks, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate metrics sink: %v", name)
+		}
+		names[name] = true
+
+		var sink Sink
+		var err error
+		switch name {
+		case "pubsub":
+			sink = NewTopic(newTopic())
+		case "stdout":
+			sink = NewStdout(os.Stdout, config.Config.MetricsCodec)
+		case FormatOCF, FormatCSV, FormatParquet:
+			sink, err = NewFile(config.Config.MetricsFileDir, name, config.Config.MetricsCodec, config.Config.MetricsFileRotateInterval, config.Config.MetricsFileRotateRecords, config.Config.MetricsFileBlockRecords)
+		default:
+			err = fmt.Errorf("unknown metrics sink: %v, pubsub, stdout, ocf, csv or parquet is expected", name)
+		}
+		if err != nil {
+			Close(sinks) // nolint: errcheck
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no metrics sink is given by METRICS_SINKS")
+	}
+	return sinks, nil
+}
+
+// Close closes all the sinks and returns their errors
+func Close(sinks []Sink) error {
+	var errs []error
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("fail to close metrics sink: %v, err: %w", sink.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type topicSink struct {
+	topic pubsub.Topic
+}
+
+// NewTopic creates the sink publishing the metrics to the Cloud Pub/Sub topic, it stops the topic when it is closed
+func NewTopic(topic pubsub.Topic) Sink {
+	return &topicSink{topic: topic}
+}
+
+// Name is the topic ID
+func (s *topicSink) Name() string {
+	return s.topic.GetID()
+}
+
+func (s *topicSink) Write(ctx context.Context, metrics map[string]interface{}) (string, error) {
+	return s.topic.Publish(ctx, metrics)
+}
+
+func (s *topicSink) Close() error {
+	s.topic.Stop()
+	return nil
+}
+
+type stdoutSink struct {
+	mux   sync.Mutex
+	w     io.Writer
+	codec *goavro.Codec
+}
+
+// NewStdout creates the sink writing the metrics to w as avro JSON, one line per metrics
+func NewStdout(w io.Writer, codec *goavro.Codec) Sink {
+	return &stdoutSink{w: w, codec: codec}
+}
+
+func (s *stdoutSink) Name() string {
+	return "stdout"
+}
+
+func (s *stdoutSink) Write(_ context.Context, metrics map[string]interface{}) (string, error) {
+	json, err := avro.EncodeToJSON(s.codec, metrics)
+	if err != nil {
+		return "", err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, err = s.w.Write(append(json, '\n'))
+	return "", err
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
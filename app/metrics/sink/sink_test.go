@@ -0,0 +1,203 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/eventgen/generator"
+	"google/jss/pubsub-integration/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func newMetrics(t *testing.T) map[string]interface{} {
+	m, err := metrics.New(generator.NewEvent(), time.Now(), time.Now(), time.Second, 2)
+	assert.Nil(t, err)
+	return m
+}
+
+// countRecords reads the records in the metrics file of the format
+func countRecords(t *testing.T, path string, format string) int {
+	switch format {
+	case FormatOCF:
+		f, err := os.Open(path)
+		assert.Nil(t, err)
+		defer f.Close() // nolint: errcheck
+		ocf, err := goavro.NewOCFReader(f)
+		assert.Nil(t, err)
+		n := 0
+		for ocf.Scan() {
+			record, err := ocf.Read()
+			assert.Nil(t, err)
+			assert.Contains(t, record, "session_id")
+			n++
+		}
+		return n
+	case FormatCSV:
+		f, err := os.Open(path)
+		assert.Nil(t, err)
+		defer f.Close() // nolint: errcheck
+		rows, err := csv.NewReader(f).ReadAll()
+		assert.Nil(t, err)
+		assert.Equal(t, "session_id", rows[0][0])
+		return len(rows) - 1
+	default:
+		f, err := local.NewLocalFileReader(path)
+		assert.Nil(t, err)
+		defer f.Close() // nolint: errcheck
+		pr, err := reader.NewParquetReader(f, nil, 1)
+		assert.Nil(t, err)
+		defer pr.ReadStop()
+		return int(pr.GetNumRows())
+	}
+}
+
+// The file is rotated by the number of records, and the completed files are readable in their format
+func TestFile(t *testing.T) {
+	for _, format := range []string{FormatOCF, FormatCSV, FormatParquet} {
+		dir := t.TempDir()
+		s, err := NewFile(dir, format, config.Config.MetricsCodec, 0, 2, 1)
+		assert.Nil(t, err)
+		var names []string
+		for i := 0; i < 3; i++ {
+			name, err := s.Write(context.Background(), newMetrics(t))
+			assert.Nil(t, err, format)
+			names = append(names, name)
+		}
+		assert.Equal(t, names[0], names[1])
+		assert.NotEqual(t, names[1], names[2])
+
+		// The file being written is in progress until it is completed
+		inProgress, err := filepath.Glob(filepath.Join(dir, "*"+inProgress))
+		assert.Nil(t, err)
+		assert.Len(t, inProgress, 1)
+
+		assert.Nil(t, s.Close())
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{filepath.Join(dir, names[0]), filepath.Join(dir, names[2])}, files)
+		assert.Equal(t, 2, countRecords(t, filepath.Join(dir, names[0]), format), format)
+		assert.Equal(t, 1, countRecords(t, filepath.Join(dir, names[2]), format), format)
+	}
+}
+
+// The ocf and parquet files buffer the metrics per block or row group, the last one is written when the file is completed
+func TestFileBlocks(t *testing.T) {
+	for _, format := range []string{FormatOCF, FormatCSV, FormatParquet} {
+		dir := t.TempDir()
+		s, err := NewFile(dir, format, config.Config.MetricsCodec, 0, 0, 2)
+		assert.Nil(t, err)
+		var name string
+		for i := 0; i < 5; i++ {
+			name, err = s.Write(context.Background(), newMetrics(t))
+			assert.Nil(t, err, format)
+		}
+		assert.Nil(t, s.Close())
+		assert.Equal(t, 5, countRecords(t, filepath.Join(dir, name), format), format)
+	}
+
+	dir := t.TempDir()
+	s, err := NewFile(dir, FormatParquet, config.Config.MetricsCodec, 0, 0, 2)
+	assert.Nil(t, err)
+	var name string
+	for i := 0; i < 5; i++ {
+		name, err = s.Write(context.Background(), newMetrics(t))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, s.Close())
+	f, err := local.NewLocalFileReader(filepath.Join(dir, name))
+	assert.Nil(t, err)
+	defer f.Close() // nolint: errcheck
+	pr, err := reader.NewParquetReader(f, nil, 1)
+	assert.Nil(t, err)
+	defer pr.ReadStop()
+	assert.Len(t, pr.Footer.RowGroups, 3)
+}
+
+// The file of the idle sink is completed after interval without writing more metrics
+func TestFileRotateIdle(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(dir, FormatParquet, config.Config.MetricsCodec, 50*time.Millisecond, 0, 10)
+	assert.Nil(t, err)
+	name, err := s.Write(context.Background(), newMetrics(t))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, countRecords(t, filepath.Join(dir, name), FormatParquet))
+	assert.Nil(t, s.Close())
+}
+
+// The file is rotated by interval
+func TestFileRotateInterval(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(dir, FormatCSV, config.Config.MetricsCodec, time.Nanosecond, 0, 1)
+	assert.Nil(t, err)
+	first, err := s.Write(context.Background(), newMetrics(t))
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond)
+	second, err := s.Write(context.Background(), newMetrics(t))
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+	assert.Nil(t, s.Close())
+	assert.Nil(t, s.Close()) // closing the closed sink does nothing
+}
+
+func TestStdout(t *testing.T) {
+	var out bytes.Buffer
+	s := NewStdout(&out, config.Config.MetricsCodec)
+	m := newMetrics(t)
+	_, err := s.Write(context.Background(), m)
+	assert.Nil(t, err)
+	assert.Equal(t, byte('\n'), out.Bytes()[out.Len()-1])
+
+	decoded, err := avro.DecodeFromJSON(config.Config.MetricsCodec, out.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, m["session_id"], decoded["session_id"])
+}
+
+func TestFromConfig(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.MetricsFileDir = t.TempDir()
+
+	config.Config.MetricsSinks = "stdout, csv,parquet"
+	sinks, err := FromConfig(nil)
+	assert.Nil(t, err)
+	var names []string
+	for _, s := range sinks {
+		names = append(names, s.Name())
+	}
+	assert.Equal(t, []string{"stdout", "csv file", "parquet file"}, names)
+	assert.Nil(t, Close(sinks))
+
+	for _, invalid := range []string{"", "stdout,stdout", "stdout,unknown"} {
+		config.Config.MetricsSinks = invalid
+		_, err = FromConfig(nil)
+		assert.NotNil(t, err, invalid)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stations joins the station metadata from a reference catalog into metrics.
+package stations
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/metrics/processor"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WatchInterval is the interval to check whether the catalog file is modified
+const WatchInterval = 10 * time.Second
+
+// UnknownStation is the name of the processor stat counting the metrics whose station is not in the catalog
+const UnknownStation = "unknown_station"
+
+// Station is the metadata of a charging station
+type Station struct {
+	ID            int32   `json:"station_id"`
+	Name          string  `json:"name"`
+	Operator      string  `json:"operator"`
+	ConnectorType string  `json:"connector_type"`
+	MaxPowerKW    float32 `json:"max_power_kw"`
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+}
+
+// Catalog is the stations keyed by station ID loaded from a CSV or JSON file, it is reloaded when the file is modified
+type Catalog struct {
+	path     string
+	mux      sync.RWMutex
+	stations map[int32]Station
+	modTime  time.Time
+	unknown  atomic.Int64 // the number of metrics whose station is not in the catalog
+}
+
+func init() {
+	metrics.Register("stations", func(ctx context.Context) (metrics.Middleware, error) {
+		if config.Config.StationCatalog == "" {
+			return nil, errors.New("STATION_CATALOG is not set")
+		}
+		catalog, err := Load(config.Config.StationCatalog)
+		if err != nil {
+			return nil, err
+		}
+		processor.RegisterStat(UnknownStation, catalog.unknown.Load)
+		go catalog.Watch(ctx, WatchInterval)
+		return metrics.Transform(catalog.Join), nil
+	})
+}
+
+// Load loads the catalog from the CSV or JSON file given by its extension
+func Load(path string) (*Catalog, error) {
+	c := &Catalog{path: path}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the catalog file again, the stations are not changed if the file is invalid
+func (c *Catalog) reload() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return fmt.Errorf("fail to read station catalog: %v, err: %w", c.path, err)
+	}
+	f, err := os.Open(c.path)
+	if err != nil {
+		return fmt.Errorf("fail to read station catalog: %v, err: %w", c.path, err)
+	}
+	defer f.Close() // nolint: errcheck
+
+	var stations []Station
+	switch filepath.Ext(c.path) {
+	case ".csv":
+		stations, err = readCSV(f)
+	case ".json":
+		err = json.NewDecoder(f).Decode(&stations)
+	default:
+		err = errors.New("the file extension is neither .csv nor .json")
+	}
+	if err != nil {
+		return fmt.Errorf("fail to parse station catalog: %v, err: %w", c.path, err)
+	}
+
+	byID := make(map[int32]Station, len(stations))
+	for _, s := range stations {
+		byID[s.ID] = s
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.stations = byID
+	c.modTime = info.ModTime()
+	slog.Info("station catalog is loaded", "path", c.path, "stations", len(byID))
+	return nil
+}
+
+// csvColumns are the columns of the CSV catalog in order, the first line is the header
+var csvColumns = []string{"station_id", "name", "operator", "connector_type", "max_power_kw", "latitude", "longitude"}
+
+func readCSV(r io.Reader) ([]Station, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(csvColumns)
+	if _, err := reader.Read(); err != nil {
+		return nil, fmt.Errorf("fail to read header, err: %w", err)
+	}
+	var stations []Station
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return stations, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.ParseInt(record[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid station_id: %v, err: %w", record[0], err)
+		}
+		maxPower, err := strconv.ParseFloat(record[4], 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_power_kw: %v, err: %w", record[4], err)
+		}
+		latitude, err := strconv.ParseFloat(record[5], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latitude: %v, err: %w", record[5], err)
+		}
+		longitude, err := strconv.ParseFloat(record[6], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid longitude: %v, err: %w", record[6], err)
+		}
+		stations = append(stations, Station{
+			ID:            int32(id),
+			Name:          record[1],
+			Operator:      record[2],
+			ConnectorType: record[3],
+			MaxPowerKW:    float32(maxPower),
+			Latitude:      latitude,
+			Longitude:     longitude,
+		})
+	}
+}
+
+// Watch reloads the catalog when the file is modified until the context is done
+func (c *Catalog) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(c.path)
+			if err != nil {
+				continue
+			}
+			c.mux.RLock()
+			modified := !info.ModTime().Equal(c.modTime)
+			c.mux.RUnlock()
+			if !modified {
+				continue
+			}
+			if err := c.reload(); err != nil {
+				slog.Error("fail to reload station catalog, keep the previous one", "err", err)
+			}
+		}
+	}
+}
+
+// Lookup returns the station of the given ID
+func (c *Catalog) Lookup(id int32) (Station, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	s, ok := c.stations[id]
+	return s, ok
+}
+
+// Join adds the metadata of the station to the metrics as optional fields, the unknown station is counted and flagged with station_known false
+func (c *Catalog) Join(m map[string]interface{}) (map[string]interface{}, error) {
+	id, err := avro.GetValue(m, "station_id", int32(0))
+	if err != nil {
+		return nil, err
+	}
+	s, ok := c.Lookup(id)
+	m["station_known"] = map[string]interface{}{"boolean": ok}
+	if !ok {
+		c.unknown.Add(1)
+		slog.Debug("unknown station", "station_id", id)
+		return m, nil
+	}
+	m["station_name"] = map[string]interface{}{"string": s.Name}
+	m["station_operator"] = map[string]interface{}{"string": s.Operator}
+	m["connector_type"] = map[string]interface{}{"string": s.ConnectorType}
+	m["max_power_kw"] = map[string]interface{}{"float": s.MaxPowerKW}
+	m["latitude"] = map[string]interface{}{"double": s.Latitude}
+	m["longitude"] = map[string]interface{}{"double": s.Longitude}
+	return m, nil
+}
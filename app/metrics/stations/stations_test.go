@@ -0,0 +1,132 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stations
+
+import (
+	"context"
+	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/eventgen/generator"
+	"google/jss/pubsub-integration/metrics"
+	"google/jss/pubsub-integration/metrics/config"
+	"google/jss/pubsub-integration/metrics/processor"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var downtown = Station{ID: 1, Name: "Downtown Garage", Operator: "ChargeCo", ConnectorType: "CCS", MaxPowerKW: 150, Latitude: 37.7749, Longitude: -122.4194}
+
+// The catalog can be loaded from CSV or JSON
+func TestLoad(t *testing.T) {
+	for _, path := range []string{"testdata/stations.csv", "testdata/stations.json"} {
+		c, err := Load(path)
+		assert.Nil(t, err, path)
+		s, ok := c.Lookup(1)
+		assert.True(t, ok)
+		assert.Equal(t, downtown, s)
+		_, ok = c.Lookup(3)
+		assert.False(t, ok)
+	}
+
+	_, err := Load("testdata/unknown.csv")
+	assert.NotNil(t, err)
+}
+
+// The station metadata is joined into the metrics, and the unknown station is counted and flagged
+func TestJoin(t *testing.T) {
+	c, err := Load("testdata/stations.csv")
+	assert.Nil(t, err)
+
+	event := generator.NewEvent()
+	event["station_id"] = int32(1)
+	m, err := metrics.Chain(metrics.New, metrics.Transform(c.Join))(event, time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"boolean": true}, m["station_known"])
+	assert.Equal(t, map[string]interface{}{"string": "Downtown Garage"}, m["station_name"])
+	assert.Equal(t, map[string]interface{}{"double": 37.7749}, m["latitude"])
+
+	// The joined metrics matches the metrics schema
+	json, err := avro.EncodeToJSON(config.Config.MetricsCodec, m)
+	assert.Nil(t, err)
+	native, err := avro.DecodeFromJSON(config.Config.MetricsCodec, json)
+	assert.Nil(t, err)
+	assert.Equal(t, m, native)
+
+	event["station_id"] = int32(100)
+	m, err = metrics.Chain(metrics.New, metrics.Transform(c.Join))(event, time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"boolean": false}, m["station_known"])
+	assert.Nil(t, m["station_name"])
+	assert.Equal(t, int64(1), c.unknown.Load())
+}
+
+// The catalog is reloaded when the file is modified, and the invalid file is ignored
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stations.csv")
+	data, err := os.ReadFile("testdata/stations.csv")
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, data, 0600))
+	c, err := Load(path)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Watch(ctx, 10*time.Millisecond)
+
+	modified := append(data, []byte("3,Harbor,ChargeCo,Type 2,22,37.8,-122.4\n")...)
+	assert.Nil(t, os.WriteFile(path, modified, 0600))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	assert.Eventually(t, func() bool {
+		_, ok := c.Lookup(3)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, os.WriteFile(path, []byte("station_id\nx\n"), 0600))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	time.Sleep(100 * time.Millisecond)
+	_, ok := c.Lookup(3)
+	assert.True(t, ok)
+}
+
+// The stations middleware is assembled from METRICS_MIDDLEWARES
+func TestMiddleware(t *testing.T) {
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	config.Config.MetricsMiddlewares = "stations"
+	// The catalog stops watching the file when the processor stops
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := metrics.FromConfig(ctx, metrics.New)
+	assert.NotNil(t, err)
+
+	config.Config.StationCatalog = "testdata/stations.json"
+	factory, err := metrics.FromConfig(ctx, metrics.New)
+	assert.Nil(t, err)
+	event := generator.NewEvent()
+	event["station_id"] = int32(2)
+	m, err := factory(event, time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"string": "VoltNet"}, m["station_operator"])
+
+	// The unknown stations are reported in the processor stats
+	before := processor.Stats()[UnknownStation]
+	event["station_id"] = int32(-1)
+	_, err = factory(event, time.Now(), time.Now(), 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, before+1, processor.Stats()[UnknownStation])
+}
@@ -17,7 +17,7 @@ package avro
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"reflect"
 
@@ -41,7 +41,7 @@ func NewCodedecFromFile(path string) (*goavro.Codec, error) {
 func EncodeToJSON(codec *goavro.Codec, data map[string]interface{}) ([]byte, error) {
 	json, err := codec.TextualFromNative(nil, data)
 	if err != nil {
-		log.Println("fail to encode data=", data, "err=", err)
+		slog.Warn("fail to encode data", "data", data, "err", err)
 	}
 	return json, err
 }
@@ -50,12 +50,12 @@ func EncodeToJSON(codec *goavro.Codec, data map[string]interface{}) ([]byte, err
 func DecodeFromJSON(codec *goavro.Codec, json []byte) (map[string]interface{}, error) {
 	native, _, err := codec.NativeFromTextual(json)
 	if err != nil {
-		log.Println("fail to decode json=", json, "err=", err)
+		slog.Warn("fail to decode json", "json", string(json), "err", err)
 		return nil, err
 	}
 	data, ok := native.(map[string]interface{})
 	if !ok {
-		log.Println("fail to decode json=", json, "err=", err)
+		slog.Warn("fail to decode json", "json", string(json), "err", err)
 		return nil, err
 	}
 	return data, err
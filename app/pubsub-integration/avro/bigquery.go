@@ -0,0 +1,160 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package avro
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// BigQueryField is a column of the BigQuery table JSON schema
+type BigQueryField struct {
+	Name   string          `json:"name"`
+	Type   string          `json:"type"`
+	Mode   string          `json:"mode"`
+	Fields []BigQueryField `json:"fields"`
+}
+
+// bigQueryTypes are the BigQuery column types that an avro type can be written to by a BigQuery subscription
+// https://cloud.google.com/pubsub/docs/bigquery#avro-to-zetasql
+var bigQueryTypes = map[string][]string{
+	"boolean":               {"BOOLEAN", "BOOL"},
+	"int":                   {"INTEGER", "INT64", "NUMERIC", "BIGNUMERIC"},
+	"long":                  {"INTEGER", "INT64", "NUMERIC", "BIGNUMERIC"},
+	"float":                 {"FLOAT", "FLOAT64", "NUMERIC", "BIGNUMERIC"},
+	"double":                {"FLOAT", "FLOAT64", "NUMERIC", "BIGNUMERIC"},
+	"bytes":                 {"BYTES"},
+	"string":                {"STRING", "JSON"},
+	"enum":                  {"STRING"},
+	"fixed":                 {"BYTES"},
+	"record":                {"RECORD", "STRUCT"},
+	"int.date":              {"DATE", "INTEGER", "INT64"},
+	"int.time-millis":       {"TIME", "INTEGER", "INT64"},
+	"long.time-micros":      {"TIME", "INTEGER", "INT64"},
+	"long.timestamp-millis": {"TIMESTAMP", "INTEGER", "INT64"},
+	"long.timestamp-micros": {"TIMESTAMP", "INTEGER", "INT64"},
+}
+
+// CheckBigQuery checks whether the records of the avro schema can be written to the BigQuery table of the given JSON schema.
+// It returns all the incompatible fields, or empty if the schemas line up.
+func CheckBigQuery(avroSchema string, bigQuerySchema string) ([]Incompatibility, error) {
+	tree, err := newSchemaTree(avroSchema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid avro schema, err: %w", err)
+	}
+	var table []BigQueryField
+	if err := json.Unmarshal([]byte(bigQuerySchema), &table); err != nil {
+		return nil, fmt.Errorf("invalid BigQuery schema, err: %w", err)
+	}
+	root, ok := tree.root.(map[string]interface{})
+	if !ok || typeOf(root) != "record" {
+		return nil, fmt.Errorf("the avro schema must be a record")
+	}
+	c := &compatibilityChecker{writer: tree}
+	c.checkBigQueryRecord(root, table, branchName(tree, root))
+	return c.result, nil
+}
+
+func (c *compatibilityChecker) checkBigQueryRecord(schema map[string]interface{}, columns []BigQueryField, path string) {
+	avroFields := map[string]bool{}
+	for _, f := range schema["fields"].([]interface{}) {
+		field := f.(map[string]interface{})
+		name := field["name"].(string)
+		avroFields[name] = true
+		fieldPath := path + "." + name
+
+		column := findColumn(columns, name)
+		if column == nil {
+			c.fail(fieldPath, "field does not exist in BigQuery table")
+			continue
+		}
+		c.checkBigQueryField(field["type"], column, fieldPath)
+	}
+	for _, column := range columns {
+		if !avroFields[column.Name] && strings.EqualFold(column.Mode, "REQUIRED") {
+			c.fail(path+"."+column.Name, "REQUIRED BigQuery column does not exist in avro schema")
+		}
+	}
+}
+
+func (c *compatibilityChecker) checkBigQueryField(fieldType interface{}, column *BigQueryField, path string) {
+	schema := c.writer.deref(fieldType)
+	mode := strings.ToUpper(column.Mode)
+	if mode == "" {
+		mode = "NULLABLE"
+	}
+
+	if branches, ok := schema.([]interface{}); ok {
+		var nonNull []interface{}
+		for _, branch := range branches {
+			if typeOf(c.writer.deref(branch)) != "null" {
+				nonNull = append(nonNull, branch)
+			}
+		}
+		if len(nonNull) != 1 {
+			c.fail(path, "only union of null and one other type is supported by BigQuery")
+			return
+		}
+		if len(nonNull) < len(branches) && mode == "REQUIRED" {
+			c.fail(path, "nullable field can not be written to REQUIRED BigQuery column")
+		}
+		schema = c.writer.deref(nonNull[0])
+	}
+
+	if typeOf(schema) == "array" {
+		if mode != "REPEATED" {
+			c.fail(path, "array field must be written to REPEATED BigQuery column, but it is %v", mode)
+			return
+		}
+		schema = c.writer.deref(schema.(map[string]interface{})["items"])
+	} else if mode == "REPEATED" {
+		c.fail(path, "REPEATED BigQuery column requires array field, but it is %v", branchName(c.writer, schema))
+		return
+	}
+
+	avroType := typeOf(schema)
+	if avroType != "record" {
+		avroType = branchName(c.writer, schema)
+		if typeOf(schema) == "enum" || typeOf(schema) == "fixed" {
+			avroType = typeOf(schema)
+		}
+	}
+	if !contains(bigQueryTypes[avroType], strings.ToUpper(column.Type)) {
+		c.fail(path, "avro type %v can not be written to BigQuery column type %v", avroType, column.Type)
+		return
+	}
+	if avroType == "record" {
+		c.checkBigQueryRecord(schema.(map[string]interface{}), column.Fields, path)
+	}
+}
+
+func findColumn(columns []BigQueryField, name string) *BigQueryField {
+	for i := range columns {
+		if columns[i].Name == name {
+			return &columns[i]
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package avro
+
+import (
+	"fmt"
+)
+
+// Compatibility is the type of schema compatibility
+type Compatibility string
+
+const (
+	// Backward means data written with the old schema can be read with the new schema
+	Backward Compatibility = "backward"
+	// Forward means data written with the new schema can be read with the old schema
+	Forward Compatibility = "forward"
+	// Full means the schemas are both backward and forward compatible
+	Full Compatibility = "full"
+)
+
+// Incompatibility describes why a field of the schemas is not compatible
+type Incompatibility struct {
+	Path   string // the path of the field, e.g. "Metrics.battery_level_end"
+	Reason string
+}
+
+func (i Incompatibility) String() string {
+	return fmt.Sprintf("%v: %v", i.Path, i.Reason)
+}
+
+// CheckCompatibility checks the compatibility between the old and the new schema.
+// It returns all the incompatible fields, or empty if the schemas are compatible.
+func CheckCompatibility(oldSchema string, newSchema string, compatibility Compatibility) ([]Incompatibility, error) {
+	oldTree, err := newSchemaTree(oldSchema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid old schema, err: %w", err)
+	}
+	newTree, err := newSchemaTree(newSchema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid new schema, err: %w", err)
+	}
+
+	var result []Incompatibility
+	switch compatibility {
+	case Backward:
+		result = checkReadable(oldTree, newTree)
+	case Forward:
+		result = checkReadable(newTree, oldTree)
+	case Full:
+		result = append(checkReadable(oldTree, newTree), checkReadable(newTree, oldTree)...)
+	default:
+		return nil, fmt.Errorf("unknown compatibility: %v", compatibility)
+	}
+	return result, nil
+}
+
+// checkReadable checks whether the data written with the writer schema can be read with the reader schema
+func checkReadable(w *schemaTree, r *schemaTree) []Incompatibility {
+	c := &compatibilityChecker{writer: w, reader: r, visited: map[string]bool{}}
+	c.check(w.root, r.root, branchName(r, r.root))
+	return c.result
+}
+
+type compatibilityChecker struct {
+	writer  *schemaTree
+	reader  *schemaTree
+	visited map[string]bool // the named types have been checked, for recursive schemas
+	result  []Incompatibility
+}
+
+func (c *compatibilityChecker) fail(path string, format string, args ...interface{}) {
+	c.result = append(c.result, Incompatibility{Path: path, Reason: fmt.Sprintf(format, args...)})
+}
+
+func (c *compatibilityChecker) check(ws interface{}, rs interface{}, path string) {
+	w, r := c.writer, c.reader
+	ws, rs = w.deref(ws), r.deref(rs)
+	wt, rt := typeOf(ws), typeOf(rs)
+
+	if wt == "union" {
+		// Every branch of the writer union must be readable
+		for _, branch := range ws.([]interface{}) {
+			c.check(branch, rs, path)
+		}
+		return
+	}
+	if rt == "union" {
+		for _, branch := range rs.([]interface{}) {
+			if matches(w, ws, r, branch) {
+				c.check(ws, branch, path)
+				return
+			}
+		}
+		c.fail(path, "writer type %v does not match any branch of reader union", branchName(w, ws))
+		return
+	}
+	if !matches(w, ws, r, rs) {
+		c.fail(path, "writer type %v can not be read as %v", branchName(w, ws), branchName(r, rs))
+		return
+	}
+
+	switch rt {
+	case "record", "error":
+		key := branchName(w, ws) + "->" + branchName(r, rs)
+		if c.visited[key] {
+			return
+		}
+		c.visited[key] = true
+		c.checkRecord(ws.(map[string]interface{}), rs.(map[string]interface{}), path)
+	case "enum":
+		c.checkEnum(ws.(map[string]interface{}), rs.(map[string]interface{}), path)
+	case "fixed":
+		if ws.(map[string]interface{})["size"] != rs.(map[string]interface{})["size"] {
+			c.fail(path, "fixed size %v can not be read as %v", ws.(map[string]interface{})["size"], rs.(map[string]interface{})["size"])
+		}
+	case "array":
+		c.check(ws.(map[string]interface{})["items"], rs.(map[string]interface{})["items"], path+"[]")
+	case "map":
+		c.check(ws.(map[string]interface{})["values"], rs.(map[string]interface{})["values"], path+"{}")
+	default:
+		if wl, rl := logicalTypeOf(ws), logicalTypeOf(rs); wl != rl {
+			c.fail(path, "logical type %q can not be read as %q", wl, rl)
+		}
+	}
+}
+
+func (c *compatibilityChecker) checkRecord(ws map[string]interface{}, rs map[string]interface{}, path string) {
+	writerFields := map[string]map[string]interface{}{}
+	for _, f := range ws["fields"].([]interface{}) {
+		field := f.(map[string]interface{})
+		writerFields[field["name"].(string)] = field
+	}
+	for _, f := range rs["fields"].([]interface{}) {
+		field := f.(map[string]interface{})
+		name := field["name"].(string)
+		fieldPath := path + "." + name
+		writerField, found := writerFields[name]
+		if !found {
+			writerField, found = aliasedField(writerFields, field)
+		}
+		if found {
+			c.check(writerField["type"], field["type"], fieldPath)
+			continue
+		}
+		def, ok := field["default"]
+		if !ok {
+			c.fail(fieldPath, "field is missing in writer schema and has no default value")
+			continue
+		}
+		if _, err := defaultValue(c.reader, field["type"], def); err != nil {
+			c.fail(fieldPath, "field is missing in writer schema and its default value is invalid: %v", err)
+		}
+	}
+}
+
+func (c *compatibilityChecker) checkEnum(ws map[string]interface{}, rs map[string]interface{}, path string) {
+	if _, ok := rs["default"]; ok {
+		return
+	}
+	symbols := map[interface{}]bool{}
+	for _, s := range rs["symbols"].([]interface{}) {
+		symbols[s] = true
+	}
+	for _, s := range ws["symbols"].([]interface{}) {
+		if !symbols[s] {
+			c.fail(path, "enum symbol %v is missing in reader schema and there is no default symbol", s)
+		}
+	}
+}
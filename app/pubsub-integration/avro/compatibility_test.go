@@ -0,0 +1,108 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package avro
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const metricsV1 = `{
+	"type": "record",
+	"name": "Metrics",
+	"fields": [
+		{"name": "session_id", "type": "string"},
+		{"name": "station_id", "type": "int"},
+		{"name": "event_timestamp", "type": {"type": "long", "logicalType": "timestamp-micros"}}
+	]
+}`
+
+// Adds an optional field and widens station_id
+const metricsV2 = `{
+	"type": "record",
+	"name": "Metrics",
+	"fields": [
+		{"name": "session_id", "type": "string"},
+		{"name": "station_id", "type": "long"},
+		{"name": "event_timestamp", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "battery_level_end", "type": ["null", "float"], "default": null}
+	]
+}`
+
+// Adds a required field without default value
+const metricsV3 = `{
+	"type": "record",
+	"name": "Metrics",
+	"fields": [
+		{"name": "session_id", "type": "string"},
+		{"name": "station_id", "type": "int"},
+		{"name": "event_timestamp", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "metrics_node", "type": "string"}
+	]
+}`
+
+func TestCheckCompatibility(t *testing.T) {
+	result, err := CheckCompatibility(metricsV1, metricsV2, Backward)
+	assert.Nil(t, err)
+	assert.Empty(t, result)
+
+	// long can not be read as int by the old schema
+	result, err = CheckCompatibility(metricsV1, metricsV2, Forward)
+	assert.Nil(t, err)
+	assert.Equal(t, []Incompatibility{{Path: "Metrics.station_id", Reason: "writer type long can not be read as int"}}, result)
+
+	// The old data does not have metrics_node, but the new schema requires it
+	result, err = CheckCompatibility(metricsV1, metricsV3, Full)
+	assert.Nil(t, err)
+	assert.Equal(t, []Incompatibility{{Path: "Metrics.metrics_node", Reason: "field is missing in writer schema and has no default value"}}, result)
+
+	_, err = CheckCompatibility(metricsV1, metricsV2, "unknown")
+	assert.NotNil(t, err)
+}
+
+func TestCheckBigQuery(t *testing.T) {
+	table := `[
+		{"name": "session_id", "type": "STRING", "mode": "REQUIRED"},
+		{"name": "station_id", "type": "INTEGER", "mode": "REQUIRED"},
+		{"name": "event_timestamp", "type": "TIMESTAMP", "mode": "REQUIRED"},
+		{"name": "battery_level_end", "type": "FLOAT", "mode": "NULLABLE"}
+	]`
+	result, err := CheckBigQuery(metricsV2, table)
+	assert.Nil(t, err)
+	assert.Empty(t, result)
+
+	// The optional column does not need to exist in avro schema
+	result, err = CheckBigQuery(metricsV1, table)
+	assert.Nil(t, err)
+	assert.Empty(t, result)
+
+	result, err = CheckBigQuery(metricsV3, table)
+	assert.Nil(t, err)
+	assert.Equal(t, []Incompatibility{{Path: "Metrics.metrics_node", Reason: "field does not exist in BigQuery table"}}, result)
+
+	table = `[
+		{"name": "session_id", "type": "INTEGER", "mode": "REQUIRED"},
+		{"name": "station_id", "type": "INTEGER", "mode": "REQUIRED"},
+		{"name": "event_timestamp", "type": "TIMESTAMP", "mode": "REQUIRED"},
+		{"name": "battery_level_end", "type": "FLOAT", "mode": "REQUIRED"}
+	]`
+	result, err = CheckBigQuery(metricsV2, table)
+	assert.Nil(t, err)
+	assert.Equal(t, []Incompatibility{
+		{Path: "Metrics.session_id", Reason: "avro type string can not be written to BigQuery column type INTEGER"},
+		{Path: "Metrics.battery_level_end", Reason: "nullable field can not be written to REQUIRED BigQuery column"},
+	}, result)
+}
@@ -0,0 +1,551 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package avro
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// Resolver converts the native data decoded by the writer schema to the native data of the reader schema.
+// It follows the avro schema resolution rules:
+// https://avro.apache.org/docs/1.11.1/specification/#schema-resolution
+type Resolver struct {
+	writer *schemaTree
+	reader *schemaTree
+}
+
+// NewResolver creates the resolver from the writer codec to the reader codec
+func NewResolver(writer *goavro.Codec, reader *goavro.Codec) (*Resolver, error) {
+	w, err := newSchemaTree(writer.Schema())
+	if err != nil {
+		return nil, fmt.Errorf("invalid writer schema, err: %w", err)
+	}
+	r, err := newSchemaTree(reader.Schema())
+	if err != nil {
+		return nil, fmt.Errorf("invalid reader schema, err: %w", err)
+	}
+	return &Resolver{writer: w, reader: r}, nil
+}
+
+// Resolve converts the given native data of the writer schema to the reader schema
+func (r *Resolver) Resolve(native interface{}) (interface{}, error) {
+	return resolve(r.writer, r.writer.root, r.reader, r.reader.root, native)
+}
+
+// ResolveRecord converts the given record of the writer schema to the record of the reader schema
+func (r *Resolver) ResolveRecord(data map[string]interface{}) (map[string]interface{}, error) {
+	native, err := r.Resolve(data)
+	if err != nil {
+		return nil, err
+	}
+	return toType(native, map[string]interface{}{})
+}
+
+// schemaTree is the parsed avro schema with the named types it defines
+type schemaTree struct {
+	root  interface{}
+	names map[string]map[string]interface{}
+	// short maps the short names to the full names of the named types
+	short map[string][]string
+	// refs are the names referencing the named types
+	refs []string
+}
+
+func newSchemaTree(schema string) (*schemaTree, error) {
+	var root interface{}
+	if err := json.Unmarshal([]byte(schema), &root); err != nil {
+		return nil, err
+	}
+	t := &schemaTree{root: root, names: map[string]map[string]interface{}{}, short: map[string][]string{}}
+	t.register(root, "")
+	// A reference by the short name must identify a single named type, otherwise the resolution depends on the map order
+	for _, ref := range t.refs {
+		if _, ok := t.names[ref]; ok {
+			continue
+		}
+		if full := t.short[ref]; len(full) > 1 {
+			return nil, fmt.Errorf("ambiguous type name: %s, candidates: %s", ref, strings.Join(full, ", "))
+		}
+	}
+	return t, nil
+}
+
+// register collects the named types (record, enum, fixed) so they can be referenced by name
+func (t *schemaTree) register(schema interface{}, namespace string) {
+	switch s := schema.(type) {
+	case string:
+		if !primitive(s) {
+			t.refs = append(t.refs, s)
+		}
+	case []interface{}:
+		for _, branch := range s {
+			t.register(branch, namespace)
+		}
+	case map[string]interface{}:
+		switch s["type"] {
+		case "record", "error", "enum", "fixed":
+			full := fullName(s, namespace)
+			if _, ok := t.names[full]; !ok {
+				t.short[shortName(full)] = append(t.short[shortName(full)], full)
+			}
+			t.names[full] = s
+			namespace = namespaceOf(full)
+			if fields, ok := s["fields"].([]interface{}); ok {
+				for _, f := range fields {
+					if field, ok := f.(map[string]interface{}); ok {
+						t.register(field["type"], namespace)
+					}
+				}
+			}
+		case "array":
+			t.register(s["items"], namespace)
+		case "map":
+			t.register(s["values"], namespace)
+		}
+	}
+}
+
+// deref returns the schema of the named type if the given schema is a reference
+func (t *schemaTree) deref(schema interface{}) interface{} {
+	name, ok := schema.(string)
+	if !ok {
+		return schema
+	}
+	if named, ok := t.names[name]; ok {
+		return named
+	}
+	if full := t.short[name]; len(full) == 1 {
+		return t.names[full[0]]
+	}
+	return schema
+}
+
+func primitive(name string) bool {
+	switch name {
+	case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+		return true
+	}
+	return false
+}
+
+func fullName(schema map[string]interface{}, namespace string) string {
+	name, _ := schema["name"].(string)
+	if strings.Contains(name, ".") {
+		return name
+	}
+	if ns, ok := schema["namespace"].(string); ok {
+		namespace = ns
+	}
+	if namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func namespaceOf(full string) string {
+	if i := strings.LastIndex(full, "."); i >= 0 {
+		return full[:i]
+	}
+	return ""
+}
+
+func shortName(full string) string {
+	return full[strings.LastIndex(full, ".")+1:]
+}
+
+// typeOf returns the avro type of the schema, e.g. "record", "long"
+func typeOf(schema interface{}) string {
+	switch s := schema.(type) {
+	case string:
+		return s
+	case []interface{}:
+		return "union"
+	case map[string]interface{}:
+		if t, ok := s["type"].(string); ok {
+			return t
+		}
+		return typeOf(s["type"])
+	}
+	return ""
+}
+
+func logicalTypeOf(schema interface{}) string {
+	if s, ok := schema.(map[string]interface{}); ok {
+		if l, ok := s["logicalType"].(string); ok {
+			return l
+		}
+	}
+	return ""
+}
+
+// branchName returns the name of the union branch used by goavro, e.g. "float", "long.timestamp-micros"
+func branchName(t *schemaTree, schema interface{}) string {
+	schema = t.deref(schema)
+	if s, ok := schema.(map[string]interface{}); ok {
+		switch s["type"] {
+		case "record", "error", "enum", "fixed":
+			return fullName(s, "")
+		}
+		if l := logicalTypeOf(s); l != "" {
+			return typeOf(s) + "." + l
+		}
+	}
+	return typeOf(schema)
+}
+
+// promotable reports whether a value of the writer type can be read as the reader type
+func promotable(writerType string, readerType string) bool {
+	if writerType == readerType {
+		return true
+	}
+	switch writerType {
+	case "int":
+		return readerType == "long" || readerType == "float" || readerType == "double"
+	case "long":
+		return readerType == "float" || readerType == "double"
+	case "float":
+		return readerType == "double"
+	case "string":
+		return readerType == "bytes"
+	case "bytes":
+		return readerType == "string"
+	}
+	return false
+}
+
+// matches reports whether the writer schema matches the reader schema according to the resolution rules
+func matches(w *schemaTree, ws interface{}, r *schemaTree, rs interface{}) bool {
+	ws, rs = w.deref(ws), r.deref(rs)
+	wt, rt := typeOf(ws), typeOf(rs)
+	switch rt {
+	case "record", "error", "enum", "fixed":
+		if wt != rt {
+			return false
+		}
+		return shortName(branchName(w, ws)) == shortName(branchName(r, rs))
+	case "array", "map", "union":
+		return wt == rt
+	}
+	return promotable(wt, rt)
+}
+
+func resolve(w *schemaTree, ws interface{}, r *schemaTree, rs interface{}, native interface{}) (interface{}, error) {
+	ws, rs = w.deref(ws), r.deref(rs)
+	wt, rt := typeOf(ws), typeOf(rs)
+
+	if wt == "union" {
+		// The value of a union is either nil or wrapped by the name of its branch
+		branch, value, err := unwrapUnion(w, ws.([]interface{}), native)
+		if err != nil {
+			return nil, err
+		}
+		return resolve(w, branch, r, rs, value)
+	}
+	if rt == "union" {
+		for _, branch := range rs.([]interface{}) {
+			if !matches(w, ws, r, branch) {
+				continue
+			}
+			value, err := resolve(w, ws, r, branch, native)
+			if err != nil {
+				return nil, err
+			}
+			if typeOf(r.deref(branch)) == "null" {
+				return nil, nil
+			}
+			return map[string]interface{}{branchName(r, branch): value}, nil
+		}
+		return nil, fmt.Errorf("no branch of reader union matches writer type %v", branchName(w, ws))
+	}
+	if !matches(w, ws, r, rs) {
+		return nil, fmt.Errorf("writer type %v does not match reader type %v", branchName(w, ws), branchName(r, rs))
+	}
+
+	switch rt {
+	case "record", "error":
+		return resolveRecord(w, ws.(map[string]interface{}), r, rs.(map[string]interface{}), native)
+	case "enum":
+		return resolveEnum(rs.(map[string]interface{}), native)
+	case "array":
+		values, ok := native.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("the type of %v is %T, but array is expected", native, native)
+		}
+		items := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			item, err := resolve(w, ws.(map[string]interface{})["items"], r, rs.(map[string]interface{})["items"], v)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case "map":
+		values, ok := native.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("the type of %v is %T, but map is expected", native, native)
+		}
+		result := make(map[string]interface{}, len(values))
+		for k, v := range values {
+			value, err := resolve(w, ws.(map[string]interface{})["values"], r, rs.(map[string]interface{})["values"], v)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = value
+		}
+		return result, nil
+	}
+	return promote(native, logicalTypeOf(ws), rt, logicalTypeOf(rs))
+}
+
+func unwrapUnion(w *schemaTree, branches []interface{}, native interface{}) (interface{}, interface{}, error) {
+	if native == nil {
+		for _, branch := range branches {
+			if typeOf(w.deref(branch)) == "null" {
+				return branch, nil, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("null is not a branch of writer union")
+	}
+	wrapped, ok := native.(map[string]interface{})
+	if !ok || len(wrapped) != 1 {
+		return nil, nil, fmt.Errorf("the type of %v is %T, but union is expected", native, native)
+	}
+	for name, value := range wrapped {
+		for _, branch := range branches {
+			if branchName(w, branch) == name {
+				return branch, value, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("%v is not a branch of writer union", name)
+	}
+	return nil, nil, nil
+}
+
+func resolveRecord(w *schemaTree, ws map[string]interface{}, r *schemaTree, rs map[string]interface{}, native interface{}) (interface{}, error) {
+	data, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the type of %v is %T, but record is expected", native, native)
+	}
+	writerFields := map[string]map[string]interface{}{}
+	for _, f := range ws["fields"].([]interface{}) {
+		field := f.(map[string]interface{})
+		writerFields[field["name"].(string)] = field
+	}
+
+	result := map[string]interface{}{}
+	for _, f := range rs["fields"].([]interface{}) {
+		field := f.(map[string]interface{})
+		name := field["name"].(string)
+		writerField, found := writerFields[name]
+		if !found {
+			writerField, found = aliasedField(writerFields, field)
+		}
+		if found {
+			value, err := resolve(w, writerField["type"], r, field["type"], data[writerField["name"].(string)])
+			if err != nil {
+				return nil, fmt.Errorf("field %v: %w", name, err)
+			}
+			result[name] = value
+			continue
+		}
+		def, ok := field["default"]
+		if !ok {
+			return nil, fmt.Errorf("field %v is missing in writer schema and has no default value", name)
+		}
+		value, err := defaultValue(r, field["type"], def)
+		if err != nil {
+			return nil, fmt.Errorf("field %v: %w", name, err)
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+func aliasedField(writerFields map[string]map[string]interface{}, field map[string]interface{}) (map[string]interface{}, bool) {
+	aliases, _ := field["aliases"].([]interface{})
+	for _, alias := range aliases {
+		if name, ok := alias.(string); ok {
+			if writerField, ok := writerFields[name]; ok {
+				return writerField, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func resolveEnum(rs map[string]interface{}, native interface{}) (interface{}, error) {
+	symbol, ok := native.(string)
+	if !ok {
+		return nil, fmt.Errorf("the type of %v is %T, but enum is expected", native, native)
+	}
+	for _, s := range rs["symbols"].([]interface{}) {
+		if s == symbol {
+			return symbol, nil
+		}
+	}
+	if def, ok := rs["default"].(string); ok {
+		return def, nil
+	}
+	return nil, fmt.Errorf("symbol %v does not exist in reader enum", symbol)
+}
+
+// promote converts primitive value to the reader type
+func promote(native interface{}, writerLogical string, readerType string, readerLogical string) (interface{}, error) {
+	if writerLogical != readerLogical {
+		return nil, fmt.Errorf("logical type %q can not be read as %q", writerLogical, readerLogical)
+	}
+	switch v := native.(type) {
+	case int32:
+		switch readerType {
+		case "long":
+			return int64(v), nil
+		case "float":
+			return float32(v), nil
+		case "double":
+			return float64(v), nil
+		}
+	case int64:
+		switch readerType {
+		case "float":
+			return float32(v), nil
+		case "double":
+			return float64(v), nil
+		}
+	case float32:
+		if readerType == "double" {
+			return float64(v), nil
+		}
+	case string:
+		if readerType == "bytes" {
+			return []byte(v), nil
+		}
+	case []byte:
+		if readerType == "string" {
+			return string(v), nil
+		}
+	}
+	return native, nil
+}
+
+// defaultValue converts the JSON default value of a field to the native value of its type
+func defaultValue(t *schemaTree, schema interface{}, def interface{}) (interface{}, error) {
+	schema = t.deref(schema)
+	switch typeOf(schema) {
+	case "union":
+		// The default value of a union corresponds to its first branch
+		branch := schema.([]interface{})[0]
+		if typeOf(t.deref(branch)) == "null" {
+			return nil, nil
+		}
+		value, err := defaultValue(t, branch, def)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{branchName(t, branch): value}, nil
+	case "null":
+		return nil, nil
+	case "record", "error":
+		values, ok := def.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid default value %v for record", def)
+		}
+		result := map[string]interface{}{}
+		for _, f := range schema.(map[string]interface{})["fields"].([]interface{}) {
+			field := f.(map[string]interface{})
+			name := field["name"].(string)
+			v, ok := values[name]
+			if !ok {
+				if v, ok = field["default"]; !ok {
+					return nil, fmt.Errorf("missing default value of field %v", name)
+				}
+			}
+			value, err := defaultValue(t, field["type"], v)
+			if err != nil {
+				return nil, err
+			}
+			result[name] = value
+		}
+		return result, nil
+	case "array":
+		values, ok := def.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid default value %v for array", def)
+		}
+		items := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			item, err := defaultValue(t, schema.(map[string]interface{})["items"], v)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case "map":
+		values, ok := def.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid default value %v for map", def)
+		}
+		result := make(map[string]interface{}, len(values))
+		for k, v := range values {
+			value, err := defaultValue(t, schema.(map[string]interface{})["values"], v)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = value
+		}
+		return result, nil
+	case "boolean":
+		if v, ok := def.(bool); ok {
+			return v, nil
+		}
+	case "int", "long", "float", "double":
+		if v, ok := def.(float64); ok {
+			return numberValue(v, typeOf(schema), logicalTypeOf(schema)), nil
+		}
+	case "string", "enum":
+		if v, ok := def.(string); ok {
+			return v, nil
+		}
+	case "bytes", "fixed":
+		if v, ok := def.(string); ok {
+			return []byte(v), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid default value %v for type %v", def, branchName(t, schema))
+}
+
+func numberValue(v float64, avroType string, logicalType string) interface{} {
+	switch avroType {
+	case "int":
+		return int32(v)
+	case "long":
+		switch logicalType {
+		case "timestamp-millis":
+			return time.UnixMilli(int64(v)).UTC()
+		case "timestamp-micros":
+			return time.UnixMicro(int64(v)).UTC()
+		}
+		return int64(v)
+	case "float":
+		return float32(v)
+	}
+	return v
+}
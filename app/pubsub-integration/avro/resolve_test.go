@@ -0,0 +1,143 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package avro
+
+import (
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const writerSchema = `{
+	"type": "record",
+	"name": "Event",
+	"fields": [
+		{"name": "session_id", "type": "string"},
+		{"name": "station_id", "type": "int"},
+		{"name": "session_end_time", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "avg_charge_rate_kw", "type": "float"},
+		{"name": "removed", "type": "string"}
+	]
+}`
+
+const readerSchema = `{
+	"type": "record",
+	"name": "Event",
+	"fields": [
+		{"name": "session_id", "type": "string"},
+		{"name": "station_id", "type": "long"},
+		{"name": "session_end_time", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "avg_charge_rate_kw", "type": ["null", "double"], "default": null},
+		{"name": "operator", "type": "string", "default": "unknown"},
+		{"name": "battery_level_end", "type": ["null", "float"], "default": null}
+	]
+}`
+
+// Data decoded by an old schema revision is upgraded to the reader schema
+func TestResolveRecord(t *testing.T) {
+	writer, err := goavro.NewCodec(writerSchema)
+	assert.Nil(t, err)
+	reader, err := goavro.NewCodec(readerSchema)
+	assert.Nil(t, err)
+	resolver, err := NewResolver(writer, reader)
+	assert.Nil(t, err)
+
+	now := time.Now().Truncate(time.Microsecond).UTC()
+	json, err := EncodeToJSON(writer, map[string]interface{}{
+		"session_id":         "id",
+		"station_id":         int32(7),
+		"session_end_time":   now,
+		"avg_charge_rate_kw": float32(1.5),
+		"removed":            "value",
+	})
+	assert.Nil(t, err)
+	native, err := DecodeFromJSON(writer, json)
+	assert.Nil(t, err)
+
+	data, err := resolver.ResolveRecord(native)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"session_id":         "id",
+		"station_id":         int64(7),
+		"session_end_time":   now,
+		"avg_charge_rate_kw": map[string]interface{}{"double": float64(1.5)},
+		"operator":           "unknown",
+		"battery_level_end":  nil,
+	}, data)
+
+	// The resolved data must be valid for the reader schema
+	_, err = EncodeToJSON(reader, data)
+	assert.Nil(t, err)
+}
+
+// Fields without default value in the reader schema can not be resolved if they are missing in the writer schema
+func TestResolveMissingField(t *testing.T) {
+	writer, err := goavro.NewCodec(`{"type": "record", "name": "Event", "fields": [{"name": "a", "type": "int"}]}`)
+	assert.Nil(t, err)
+	reader, err := goavro.NewCodec(`{"type": "record", "name": "Event", "fields": [{"name": "b", "type": "int"}]}`)
+	assert.Nil(t, err)
+	resolver, err := NewResolver(writer, reader)
+	assert.Nil(t, err)
+
+	_, err = resolver.ResolveRecord(map[string]interface{}{"a": int32(1)})
+	assert.NotNil(t, err)
+}
+
+// Values can not be narrowed to a smaller type
+func TestResolveTypeMismatch(t *testing.T) {
+	writer, err := goavro.NewCodec(`{"type": "record", "name": "Event", "fields": [{"name": "a", "type": "long"}]}`)
+	assert.Nil(t, err)
+	reader, err := goavro.NewCodec(`{"type": "record", "name": "Event", "fields": [{"name": "a", "type": "int"}]}`)
+	assert.Nil(t, err)
+	resolver, err := NewResolver(writer, reader)
+	assert.Nil(t, err)
+
+	_, err = resolver.ResolveRecord(map[string]interface{}{"a": int64(1)})
+	assert.NotNil(t, err)
+}
+
+// Types referenced by a short name shared by several namespaces are rejected instead of resolved by chance
+func TestResolveAmbiguousName(t *testing.T) {
+	codec, err := goavro.NewCodec(`{
+		"type": "record",
+		"name": "Event",
+		"namespace": "a",
+		"fields": [
+			{"name": "first", "type": {"type": "record", "name": "Station", "fields": [{"name": "id", "type": "int"}]}},
+			{"name": "second", "type": {"type": "record", "name": "Station", "namespace": "b", "fields": [{"name": "id", "type": "long"}]}},
+			{"name": "third", "type": "Station"}
+		]
+	}`)
+	assert.Nil(t, err)
+	_, err = NewResolver(codec, codec)
+	assert.ErrorContains(t, err, "ambiguous type name: Station")
+
+	// The full name is not ambiguous
+	codec, err = goavro.NewCodec(`{
+		"type": "record",
+		"name": "Event",
+		"namespace": "a",
+		"fields": [
+			{"name": "first", "type": {"type": "record", "name": "Station", "fields": [{"name": "id", "type": "int"}]}},
+			{"name": "second", "type": {"type": "record", "name": "Station", "namespace": "b", "fields": [{"name": "id", "type": "long"}]}},
+			{"name": "third", "type": "b.Station"}
+		]
+	}`)
+	assert.Nil(t, err)
+	_, err = NewResolver(codec, codec)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,577 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loader loads typed and validated config from defaults, a YAML file, environment variables and command-line flags.
+//
+// The fields to be loaded are declared by struct tags:
+//
+//	type config struct {
+//		BatchSize int           `env:"PUBLISHER_BATCH_SIZE" default:"100" validate:"min=1"`
+//		Timeout   time.Duration `env:"PUBLISHER_TIMEOUT" default:"60" unit:"s"`
+//	}
+//
+// The fields of the embedded structs are loaded as well, so that the config can be grouped by feature.
+// The env tag is the environment variable name. The YAML key is the lowercase env name, e.g. publisher_batch_size,
+// and the flag name is the lowercase env name with dashes, e.g. -publisher-batch-size.
+// The flags are parsed by the flag package, e.g. -name=value or -name value, and the boolean flags take no separate value, e.g. -name or -name=false.
+// The later source overrides the former: default < YAML file < environment variable < flag.
+// Empty environment variables are ignored, e.g. the unset variables passed by docker compose.
+// The YAML file is given by the -config flag or the CONFIG_FILE environment variable.
+// The flags matching no field are rejected by CheckFlags once the config of all the packages has been loaded.
+//
+// The fields tagged with reload:"live" can be changed at runtime by Reload, see Watch.
+package loader
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Source is where the value of a config field comes from
+type Source string
+
+const (
+	// Default is the default value declared by the default tag
+	Default Source = "default"
+	// File is the YAML config file
+	File Source = "file"
+	// Env is the environment variable
+	Env Source = "env"
+	// Flag is the command-line flag
+	Flag Source = "flag"
+)
+
+// ConfigFileEnv is the environment variable of the YAML config file path
+const ConfigFileEnv = "CONFIG_FILE"
+
+// ConfigFileFlag is the command-line flag of the YAML config file path
+const ConfigFileFlag = "config"
+
+// Loader loads config from the given sources
+type Loader struct {
+	Args      []string                    // the command-line arguments without the program name
+	LookupEnv func(string) (string, bool) // the function to look up environment variables
+}
+
+// New creates the loader for the command-line arguments and environment variables of the process
+func New() *Loader {
+	return &Loader{
+		Args:      os.Args[1:],
+		LookupEnv: os.LookupEnv,
+	}
+}
+
+// Load loads the config of the process into the given struct pointer, see Loader.Load
+func Load(cfg interface{}) (*Result, error) {
+	return New().Load(cfg)
+}
+
+// Field is a loaded config field
+type Field struct {
+	Name   string // the struct field name
+	Env    string // the environment variable name
+	Value  reflect.Value
+	Source Source
+	tag    reflect.StructTag
+}
+
+// Result is the loaded config fields
+type Result struct {
+	Fields []*Field
+}
+
+// String prints the effective config with the source of each field
+func (r *Result) String() string {
+	var b strings.Builder
+	for _, f := range r.Fields {
+		source := f.Source
+		if source == "" {
+			source = "unset"
+		}
+		fmt.Fprintf(&b, "  %v=%v (%v)\n", f.Env, format(f.Value), source)
+	}
+	return b.String()
+}
+
+// LogValue logs the effective config as a group of env=value (source)
+func (r *Result) LogValue() slog.Value {
+	attrs := make([]slog.Attr, 0, len(r.Fields))
+	for _, f := range r.Fields {
+		source := f.Source
+		if source == "" {
+			source = "unset"
+		}
+		attrs = append(attrs, slog.String(f.Env, fmt.Sprintf("%v (%v)", f.Value.Interface(), source)))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// format quotes string values, so that empty value can be seen
+func format(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return strconv.Quote(v.String())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// Source returns the source of the field of the given environment variable name
+func (r *Result) Source(env string) Source {
+	for _, f := range r.Fields {
+		if f.Env == env {
+			return f.Source
+		}
+	}
+	return ""
+}
+
+// Load fills the tagged fields of the given struct pointer.
+// It returns all the invalid values together, so that they can be fixed at once.
+func (l *Loader) Load(cfg interface{}) (*Result, error) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config must be a struct pointer, but it is %T", cfg)
+	}
+	v = v.Elem()
+
+	result := &Result{Fields: fields(v)}
+	register(result.Fields)
+	flags, _, err := parseFlags(l.Args, flagKinds(result.Fields))
+	if err != nil {
+		return nil, err
+	}
+	values, err := l.readFile(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, f := range result.Fields {
+		if err := l.loadField(f, values, flags); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := validate(f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// fields returns the tagged fields of the struct and its embedded structs in order
+func fields(v reflect.Value) []*Field {
+	var fs []*Field
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			fs = append(fs, fields(v.Field(i))...)
+			continue
+		}
+		name, ok := sf.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		fs = append(fs, &Field{Name: sf.Name, Env: name, Value: v.Field(i), tag: sf.Tag})
+	}
+	return fs
+}
+
+// loadField sets the value of the field from the source with the highest priority
+func (l *Loader) loadField(f *Field, values map[string]interface{}, flags map[string]string) error {
+	if def, ok := f.tag.Lookup("default"); ok {
+		if err := set(f, def, Default); err != nil {
+			return err
+		}
+	}
+	if value, ok := values[strings.ToLower(f.Env)]; ok {
+		if err := set(f, fmt.Sprint(value), File); err != nil {
+			return err
+		}
+	}
+	if value, ok := l.LookupEnv(f.Env); ok && value != "" {
+		if err := set(f, value, Env); err != nil {
+			return err
+		}
+	}
+	if value, ok := flags[flagName(f.Env)]; ok {
+		if err := set(f, value, Flag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+// flagKinds returns the flag names of the fields and the config file flag, the value tells whether it is a boolean flag
+func flagKinds(fields []*Field) map[string]bool {
+	kinds := map[string]bool{ConfigFileFlag: false}
+	for _, f := range fields {
+		kinds[flagName(f.Env)] = f.Value.Kind() == reflect.Bool
+	}
+	return kinds
+}
+
+// known is the flags of the fields loaded by the process, since several packages load their own config from the same arguments
+var (
+	knownMux sync.Mutex
+	known    = map[string]bool{ConfigFileFlag: false}
+)
+
+// register adds the flags of the fields to the known flags
+func register(fields []*Field) {
+	knownMux.Lock()
+	defer knownMux.Unlock()
+	for name, isBool := range flagKinds(fields) {
+		known[name] = isBool
+	}
+}
+
+// CheckFlags returns an error if any flag matches none of the fields loaded so far, e.g. a misspelled flag.
+// It is called after the config of all the packages used by the process has been loaded.
+func (l *Loader) CheckFlags() error {
+	knownMux.Lock()
+	defer knownMux.Unlock()
+	_, unknown, err := parseFlags(l.Args, known)
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown flags: %v", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// CheckFlags checks the command-line arguments of the process, see Loader.CheckFlags
+func CheckFlags() error {
+	return New().CheckFlags()
+}
+
+// flagValue records the value of a flag as string, it is parsed to the type of the field by set
+type flagValue struct {
+	name   string
+	values map[string]string
+	isBool bool
+}
+
+func (v *flagValue) String() string {
+	if v == nil || v.values == nil {
+		return ""
+	}
+	return v.values[v.name]
+}
+
+func (v *flagValue) Set(value string) error {
+	v.values[v.name] = value
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// parseFlags parses the arguments by the flag set of the given flags, the value tells whether it is a boolean flag.
+// It returns the values of the given flags and the names of the other flags found in the arguments.
+// The other flags are kept as boolean flags, since several packages can load their own config from the same arguments,
+// and the arguments which are not flags are skipped, e.g. the value of the other flag.
+func parseFlags(args []string, kinds map[string]bool) (map[string]string, []string, error) {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	values := map[string]string{}
+	for name, isBool := range kinds {
+		fs.Var(&flagValue{name: name, values: values, isBool: isBool}, name, "")
+	}
+	others := map[string]string{}
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name == "" || fs.Lookup(name) != nil {
+			continue
+		}
+		fs.Var(&flagValue{name: name, values: others, isBool: true}, name, "")
+	}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, nil, fmt.Errorf("invalid flags, err: %w", err)
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		args = fs.Args()[1:]
+	}
+
+	var unknown []string
+	for name := range others {
+		if !strings.HasPrefix(name, "test.") { // the flags of go test
+			unknown = append(unknown, "-"+name)
+		}
+	}
+	return values, unknown, nil
+}
+
+// configFile returns the path of the YAML config file, or empty if there is no config file
+func (l *Loader) configFile(flags map[string]string) string {
+	path, ok := flags[ConfigFileFlag]
+	if !ok {
+		path, _ = l.LookupEnv(ConfigFileEnv)
+	}
+	return path
+}
+
+// readFile reads the YAML config file, it returns empty if there is no config file
+func (l *Loader) readFile(flags map[string]string) (map[string]interface{}, error) {
+	path := l.configFile(flags)
+	values := map[string]interface{}{}
+	if path == "" {
+		return values, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read config file, err: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("invalid config file %v, err: %w", path, err)
+	}
+	return values, nil
+}
+
+// set parses the string value to the type of the field
+func set(f *Field, value string, source Source) error {
+	fail := func(err error) error {
+		return fmt.Errorf("invalid value %q of %v from %v: %w", value, f.Env, source, err)
+	}
+	switch f.Value.Interface().(type) {
+	case time.Duration:
+		d, err := parseDuration(value, f.tag.Get("unit"))
+		if err != nil {
+			return fail(err)
+		}
+		f.Value.SetInt(int64(d))
+	case string:
+		f.Value.SetString(value)
+	case int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fail(errors.New("integer is expected"))
+		}
+		f.Value.SetInt(int64(i))
+	case float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fail(errors.New("number is expected"))
+		}
+		f.Value.SetFloat(n)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fail(errors.New("boolean is expected"))
+		}
+		f.Value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %v of %v", f.Value.Type(), f.Env)
+	}
+	f.Source = source
+	return nil
+}
+
+var units = map[string]time.Duration{
+	"":   time.Second,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// parseDuration parses Go duration string, e.g. "1m30s", or a plain number in the given unit
+func parseDuration(value string, unit string) (time.Duration, error) {
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		u, ok := units[unit]
+		if !ok {
+			return 0, fmt.Errorf("unknown unit %q", unit)
+		}
+		return time.Duration(n * float64(u)), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New("duration is expected, e.g. 1.5 or 1m30s")
+	}
+	return d, nil
+}
+
+// validate checks the value by the rules of validate tag, e.g. "min=0,max=1", "required", "oneof=a b"
+func validate(f *Field) error {
+	rules := f.tag.Get("validate")
+	if rules == "" {
+		return nil
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		if err := check(f.Value, name, arg); err != nil {
+			return fmt.Errorf("invalid value %v of %v from %v: %w", format(f.Value), f.Env, f.Source, err)
+		}
+	}
+	return nil
+}
+
+func check(v reflect.Value, rule string, arg string) error {
+	switch rule {
+	case "required":
+		if v.IsZero() {
+			return errors.New("it is required")
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return fmt.Errorf("invalid rule %v=%v", rule, arg)
+		}
+		n := number(v)
+		if rule == "min" && n < limit {
+			return fmt.Errorf("it must be >= %v", arg)
+		}
+		if rule == "max" && n > limit {
+			return fmt.Errorf("it must be <= %v", arg)
+		}
+	case "oneof":
+		options := strings.Fields(arg)
+		for _, o := range options {
+			if fmt.Sprint(v.Interface()) == o {
+				return nil
+			}
+		}
+		return fmt.Errorf("it must be one of %v", strings.Join(options, ", "))
+	default:
+		return fmt.Errorf("unknown rule %v", rule)
+	}
+	return nil
+}
+
+// number returns the numeric value to validate, durations are validated in seconds
+func number(v reflect.Value) float64 {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.Seconds()
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return float64(len(v.String()))
+	}
+	return 0
+}
+
+// Change is the changed value of a config field found by Reload
+type Change struct {
+	Env  string
+	From interface{}
+	To   interface{}
+	Live bool // whether the change has been applied, otherwise it requires restart
+}
+
+func (c Change) String() string {
+	if c.Live {
+		return fmt.Sprintf("%v changed from %v to %v", c.Env, c.From, c.To)
+	}
+	return fmt.Sprintf("%v changed from %v to %v, but it requires rebuilding the clients, restart to apply it", c.Env, c.From, c.To)
+}
+
+// Reload loads the config again and applies the changed values of the fields tagged with reload:"live" to the given struct pointer.
+// The changes of other fields are returned but not applied, since they require rebuilding the clients.
+// Nothing is applied if any value is invalid.
+func (l *Loader) Reload(cfg interface{}) ([]Change, error) {
+	current := reflect.ValueOf(cfg)
+	if current.Kind() != reflect.Pointer || current.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config must be a struct pointer, but it is %T", cfg)
+	}
+	loaded := reflect.New(current.Elem().Type())
+	result, err := l.Load(loaded.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for _, f := range result.Fields {
+		field := current.Elem().FieldByName(f.Name)
+		if field.Interface() == f.Value.Interface() {
+			continue
+		}
+		change := Change{Env: f.Env, From: field.Interface(), To: f.Value.Interface(), Live: f.tag.Get("reload") == "live"}
+		if change.Live {
+			field.Set(f.Value)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// Watch calls onChange when the process receives SIGHUP or the config file is modified.
+// The config file is checked every interval, e.g. a mounted ConfigMap is updated.
+// It blocks until ctx is done.
+func (l *Loader) Watch(ctx context.Context, interval time.Duration, onChange func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	flags, _, _ := parseFlags(l.Args, map[string]bool{ConfigFileFlag: false})
+	path := l.configFile(flags)
+	modTime := lastModified(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("reload config on SIGHUP")
+			onChange()
+		case <-ticker.C:
+			if path == "" {
+				continue
+			}
+			if t := lastModified(path); !t.Equal(modTime) {
+				modTime = t
+				slog.Info("reload config on modified file", "path", path)
+				onChange()
+			}
+		}
+	}
+}
+
+func lastModified(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
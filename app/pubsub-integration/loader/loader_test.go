@@ -0,0 +1,223 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testConfig struct {
+	Topic     string        `env:"TOPIC" default:"Topic" validate:"required"`
+	BatchSize int           `env:"BATCH_SIZE" default:"100" validate:"min=1"`
+	Ratio     float64       `env:"RATIO" default:"0.5" validate:"min=0,max=1"`
+	Timeout   time.Duration `env:"TIMEOUT" default:"5" unit:"m"`
+	Mode      string        `env:"MODE" default:"block" validate:"oneof=block ignore error"`
+	Enabled   bool          `env:"ENABLED"`
+	Node      string        // not loaded
+}
+
+func newLoader(args []string, env map[string]string) *Loader {
+	return &Loader{
+		Args: args,
+		LookupEnv: func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		},
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadDefault(t *testing.T) {
+	var cfg testConfig
+	result, err := newLoader(nil, nil).Load(&cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, testConfig{Topic: "Topic", BatchSize: 100, Ratio: 0.5, Timeout: 5 * time.Minute, Mode: "block"}, cfg)
+	assert.Equal(t, Default, result.Source("BATCH_SIZE"))
+	assert.Equal(t, Source(""), result.Source("ENABLED"))
+}
+
+// The later source overrides the former: default < YAML file < environment variable < flag
+func TestLoadPriority(t *testing.T) {
+	path := writeFile(t, "topic: FileTopic\nbatch_size: 10\nratio: 0.1\nunknown: value\n")
+	env := map[string]string{ConfigFileEnv: path, "BATCH_SIZE": "20", "RATIO": "0.2", "MODE": ""}
+	args := []string{"-test.v", "--ratio=0.3", "-timeout", "1m30s", "-enabled"}
+
+	var cfg testConfig
+	result, err := newLoader(args, env).Load(&cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, testConfig{Topic: "FileTopic", BatchSize: 20, Ratio: 0.3, Timeout: 90 * time.Second, Mode: "block", Enabled: true}, cfg)
+	assert.Equal(t, File, result.Source("TOPIC"))
+	assert.Equal(t, Env, result.Source("BATCH_SIZE"))
+	assert.Equal(t, Flag, result.Source("RATIO"))
+	assert.Equal(t, Default, result.Source("MODE")) // empty environment variable is ignored
+}
+
+// All the invalid values are reported together
+func TestLoadInvalid(t *testing.T) {
+	env := map[string]string{"BATCH_SIZE": "abc", "RATIO": "2", "TIMEOUT": "soon", "MODE": "drop"}
+
+	var cfg testConfig
+	_, err := newLoader([]string{"-topic="}, env).Load(&cfg)
+	assert.EqualError(t, err, `invalid value "" of TOPIC from flag: it is required
+invalid value "abc" of BATCH_SIZE from env: integer is expected
+invalid value 2 of RATIO from env: it must be <= 1
+invalid value "soon" of TIMEOUT from env: duration is expected, e.g. 1.5 or 1m30s
+invalid value "drop" of MODE from env: it must be one of block, ignore, error`)
+}
+
+func TestLoadConfigFileFlag(t *testing.T) {
+	path := writeFile(t, "batch_size: 10\n")
+
+	var cfg testConfig
+	_, err := newLoader([]string{"-config", path}, nil).Load(&cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, cfg.BatchSize)
+
+	_, err = newLoader([]string{"-config", path + ".missing"}, nil).Load(&cfg)
+	assert.NotNil(t, err)
+}
+
+// The negative number is the value of the flag
+func TestLoadNegativeFlag(t *testing.T) {
+	var cfg testConfig
+	_, err := newLoader([]string{"-ratio", "-0.5"}, nil).Load(&cfg)
+	assert.EqualError(t, err, `invalid value -0.5 of RATIO from flag: it must be >= 0`)
+}
+
+// The boolean flag takes no separate value, the next argument is not its value
+func TestLoadBoolFlag(t *testing.T) {
+	var cfg testConfig
+	_, err := newLoader([]string{"-enabled", "false", "-batch-size", "10"}, nil).Load(&cfg)
+	assert.Nil(t, err)
+	assert.True(t, cfg.Enabled)
+	assert.Equal(t, 10, cfg.BatchSize)
+
+	_, err = newLoader([]string{"-enabled=false"}, nil).Load(&cfg)
+	assert.Nil(t, err)
+	assert.False(t, cfg.Enabled)
+
+	_, err = newLoader([]string{"-enabled=maybe"}, nil).Load(&cfg)
+	assert.ErrorContains(t, err, `invalid value "maybe" of ENABLED from flag`)
+
+	// The missing value of the flag is reported
+	_, err = newLoader([]string{"-batch-size"}, nil).Load(&cfg)
+	assert.ErrorContains(t, err, "flag needs an argument: -batch-size")
+}
+
+// The flags matching none of the loaded fields are rejected
+func TestCheckFlags(t *testing.T) {
+	var cfg testConfig
+	l := newLoader([]string{"-test.v", "-batch-size", "10", "-enabled", "-ratio", "-1"}, nil)
+	_, err := l.Load(&cfg)
+	assert.NotNil(t, err)
+	assert.Nil(t, l.CheckFlags())
+
+	l.Args = []string{"-test.v", "-batch-size", "10", "-batchsize=20", "-enabld", "-config", "config.yaml"}
+	assert.EqualError(t, l.CheckFlags(), "unknown flags: -batchsize, -enabld")
+}
+
+type publisherConfig struct {
+	BatchSize int `env:"BATCH_SIZE" default:"100" validate:"min=1" reload:"live"`
+}
+
+type groupedConfig struct {
+	Topic string `env:"TOPIC" default:"Topic"`
+	publisherConfig
+}
+
+// The fields of the embedded structs are loaded and reloaded as the fields of the config
+func TestLoadEmbedded(t *testing.T) {
+	path := writeFile(t, "batch_size: 10\n")
+	l := newLoader([]string{"-config", path, "-topic", "FlagTopic"}, nil)
+	var cfg groupedConfig
+	result, err := l.Load(&cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "FlagTopic", cfg.Topic)
+	assert.Equal(t, 10, cfg.BatchSize)
+	assert.Equal(t, File, result.Source("BATCH_SIZE"))
+
+	assert.Nil(t, os.WriteFile(path, []byte("batch_size: 20\n"), 0600))
+	changes, err := l.Reload(&cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Env: "BATCH_SIZE", From: 10, To: 20, Live: true}}, changes)
+	assert.Equal(t, 20, cfg.BatchSize)
+}
+
+type liveConfig struct {
+	Topic     string  `env:"TOPIC" default:"Topic"`
+	BatchSize int     `env:"BATCH_SIZE" default:"100" validate:"min=1" reload:"live"`
+	Ratio     float64 `env:"RATIO" default:"0.5" validate:"min=0,max=1" reload:"live"`
+}
+
+// Only the live fields are applied, the changes of others are reported
+func TestReload(t *testing.T) {
+	path := writeFile(t, "batch_size: 10\n")
+	l := newLoader([]string{"-config", path}, nil)
+	var cfg liveConfig
+	_, err := l.Load(&cfg)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(path, []byte("batch_size: 20\ntopic: NewTopic\n"), 0600))
+	changes, err := l.Reload(&cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{
+		{Env: "TOPIC", From: "Topic", To: "NewTopic", Live: false},
+		{Env: "BATCH_SIZE", From: 10, To: 20, Live: true},
+	}, changes)
+	assert.Equal(t, liveConfig{Topic: "Topic", BatchSize: 20, Ratio: 0.5}, cfg)
+
+	// Nothing is applied if any value is invalid
+	assert.Nil(t, os.WriteFile(path, []byte("batch_size: 30\nratio: 2\n"), 0600))
+	_, err = l.Reload(&cfg)
+	assert.NotNil(t, err)
+	assert.Equal(t, liveConfig{Topic: "Topic", BatchSize: 20, Ratio: 0.5}, cfg)
+}
+
+func TestWatch(t *testing.T) {
+	path := writeFile(t, "batch_size: 10\n")
+	l := newLoader([]string{"-config", path}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloaded := make(chan struct{}, 1)
+	go l.Watch(ctx, 10*time.Millisecond, func() { reloaded <- struct{}{} })
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "not reloaded on modified config file")
+	}
+
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "not reloaded on SIGHUP")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging sets up the structured leveled logging of log/slog.
+// The default slog logger is replaced when the package is initialized, so that all the packages can use slog directly.
+package logging
+
+import (
+	"context"
+	"google/jss/pubsub-integration/loader"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// The common attribute keys
+const (
+	RunID        = "run_id"
+	Publisher    = "publisher"
+	MessageID    = "message_id"
+	Subscription = "subscription"
+	Topic        = "topic"
+	Attempt      = "delivery_attempt"
+)
+
+type config struct {
+	Level    string `env:"LOG_LEVEL" default:"info" validate:"oneof=debug info warn error" reload:"live"`
+	Format   string `env:"LOG_FORMAT" default:"json" validate:"oneof=json text"`
+	Sampling int    `env:"LOG_SAMPLING" default:"100" validate:"min=1" reload:"live"` // log one of every N messages on hot paths
+}
+
+// Config is the logging configuration parsed from defaults, config file, environment variables and flags.
+var Config config
+
+var mux sync.Mutex // protects Config on reload
+var level slog.LevelVar
+var sampling atomic.Int64
+
+func init() {
+	result, err := loader.Load(&Config)
+	if err != nil {
+		log.Fatalf("invalid config, err: %v", err)
+	}
+	Setup(os.Stdout, Config.Format)
+	if err := apply(); err != nil {
+		Fatal("invalid log level", "err", err)
+	}
+	slog.Info("using logging config", "config", result)
+}
+
+// Setup replaces the default logger with the json or text handler writing to the given writer
+func Setup(w io.Writer, format string) {
+	opts := &slog.HandlerOptions{Level: &level}
+	var handler slog.Handler
+	if format == "text" {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// apply applies the level and sampling of Config
+func apply() error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(Config.Level)); err != nil {
+		return err
+	}
+	level.Set(l)
+	sampling.Store(int64(Config.Sampling))
+	return nil
+}
+
+// Reload reloads the log level and sampling, it is called when the config of the process is reloaded
+func Reload() {
+	mux.Lock()
+	defer mux.Unlock()
+	changes, err := loader.New().Reload(&Config)
+	if err != nil {
+		slog.Warn("fail to reload logging config, keep using the current config", "err", err)
+		return
+	}
+	for _, change := range changes {
+		slog.Info("reload config", "change", change.String())
+	}
+	if err := apply(); err != nil {
+		slog.Warn("fail to apply logging config", "err", err)
+	}
+}
+
+// Fatal logs the error and exits the process
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Sampler samples the messages on hot paths, so that only one of every LOG_SAMPLING messages is logged.
+// All the records of a sampled message are logged, so that the message can be followed.
+type Sampler struct {
+	count atomic.Int64
+}
+
+// Logger returns the given logger if the next message is sampled, otherwise the logger only logs errors
+func (s *Sampler) Logger(logger *slog.Logger) *slog.Logger {
+	if (s.count.Add(1)-1)%sampling.Load() == 0 {
+		return logger
+	}
+	return slog.New(&errorHandler{Handler: logger.Handler()})
+}
+
+// errorHandler only handles the records of error level
+type errorHandler struct {
+	slog.Handler
+}
+
+func (h *errorHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= slog.LevelError && h.Handler.Enabled(ctx, l)
+}
+
+func (h *errorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &errorHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *errorHandler) WithGroup(name string) slog.Handler {
+	return &errorHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+type contextKey struct{}
+
+// NewContext returns the context carrying the logger
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by the context, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func records(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var result []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &record))
+		result = append(result, record)
+	}
+	buf.Reset()
+	return result
+}
+
+// useLogger replaces the default logger with the one writing json to buf at info level, regardless of LOG_LEVEL
+func useLogger(t *testing.T, buf *bytes.Buffer) {
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+}
+
+func TestSampler(t *testing.T) {
+	var buf bytes.Buffer
+	useLogger(t, &buf)
+	sampling.Store(3)
+	t.Cleanup(func() { sampling.Store(int64(Config.Sampling)) })
+
+	var sampler Sampler
+	logger := slog.With(Publisher, "publisher-0")
+	for i := 0; i < 6; i++ {
+		sampled := sampler.Logger(logger).With(MessageID, i)
+		sampled.Info("published message")
+		sampled.Error("fail to publish message") // errors are always logged
+	}
+
+	var infos, errs []interface{}
+	for _, record := range records(t, &buf) {
+		assert.Equal(t, "publisher-0", record[Publisher])
+		if record["level"] == "INFO" {
+			infos = append(infos, record[MessageID])
+		} else {
+			errs = append(errs, record[MessageID])
+		}
+	}
+	assert.Equal(t, []interface{}{0.0, 3.0}, infos)
+	assert.Len(t, errs, 6)
+}
+
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+	useLogger(t, &buf)
+
+	FromContext(context.Background()).Info("default logger")
+	ctx := NewContext(context.Background(), slog.With(RunID, "run"))
+	FromContext(ctx).Info("run logger")
+
+	result := records(t, &buf)
+	if assert.Len(t, result, 2) {
+		assert.Nil(t, result[0][RunID])
+		assert.Equal(t, "run", result[1][RunID])
+	}
+}
@@ -16,20 +16,23 @@
 package config
 
 import (
-	"google/jss/pubsub-integration/env"
-	"log"
+	"google/jss/pubsub-integration/loader"
+	"google/jss/pubsub-integration/logging"
+	"log/slog"
 )
 
 type config struct {
-	Project string
+	Project      string `env:"GOOGLE_CLOUD_PROJECT"`
+	EmulatorHost string `env:"PUBSUB_EMULATOR_HOST"` // the host of the Cloud Pub/Sub emulator, the clients connect to it instead of Cloud Pub/Sub if it is set
 }
 
 // Config is the global configuration parsed from environment variables.
 var Config config
 
 func init() {
-	Config = config{
-		Project: env.GetEnv("GOOGLE_CLOUD_PROJECT", ""),
+	result, err := loader.Load(&Config)
+	if err != nil {
+		logging.Fatal("invalid config", "err", err)
 	}
-	log.Printf("using config: %+v", Config)
+	slog.Info("using pubsub config", "config", result)
 }
@@ -17,17 +17,26 @@ package pubsub
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"google/jss/pubsub-integration/avro"
+	"google/jss/pubsub-integration/logging"
 	"google/jss/pubsub-integration/pubsub/config"
-	"log"
+	"google/jss/pubsub-integration/tracing"
+	"log/slog"
 	"time"
 
 	"cloud.google.com/go/pubsub"
 	vkit "cloud.google.com/go/pubsub/apiv1"
 	"github.com/googleapis/gax-go/v2"
 	"github.com/linkedin/goavro/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 type service interface {
@@ -40,6 +49,11 @@ var Service service = new(pubsubService)
 type pubsubService struct {
 }
 
+// UsingEmulator reports whether the clients connect to the Cloud Pub/Sub emulator
+func UsingEmulator() bool {
+	return config.Config.EmulatorHost != ""
+}
+
 // NewClientBackoffConfig creates the default backoff config for Cloud Pub/Sub client
 func NewClientBackoffConfig(initial time.Duration, max time.Duration) *pubsub.ClientConfig {
 	// initial: the initial value of the retry period
@@ -69,7 +83,29 @@ func NewClientBackoffConfig(initial time.Duration, max time.Duration) *pubsub.Cl
 
 // NewClient creates the client for bucket handling. Using the default backoff config if clientCfg is nil
 func (*pubsubService) NewClient(ctx context.Context, clientCfg *pubsub.ClientConfig) (Client, error) {
-	client, err := pubsub.NewClientWithConfig(ctx, config.Config.Project, clientCfg)
+	if config.Config.Project == "" {
+		return nil, errors.New("fail to create client, GOOGLE_CLOUD_PROJECT is required")
+	}
+	return NewClientWithOptions(ctx, config.Config.Project, clientCfg, emulatorOptions()...)
+}
+
+// emulatorOptions returns the options connecting to the emulator if it is used.
+// The client library only reads PUBSUB_EMULATOR_HOST from the environment, so the host given by the flag or the config file is passed explicitly.
+func emulatorOptions() []option.ClientOption {
+	if !UsingEmulator() {
+		return nil
+	}
+	return []option.ClientOption{
+		option.WithEndpoint(config.Config.EmulatorHost),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		option.WithTelemetryDisabled(),
+	}
+}
+
+// NewClientWithOptions creates the client of the given project with the client options, e.g. connecting to a fake server
+func NewClientWithOptions(ctx context.Context, projectID string, clientCfg *pubsub.ClientConfig, opts ...option.ClientOption) (Client, error) {
+	client, err := pubsub.NewClientWithConfig(ctx, projectID, clientCfg, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -78,8 +114,10 @@ func (*pubsubService) NewClient(ctx context.Context, clientCfg *pubsub.ClientCon
 
 // Client is the interface of the Cloud Pub/Sub client for Pub/Sub handling.
 type Client interface {
-	NewTopic(string, *goavro.Codec, int, int, int) Topic
-	NewSubscription(string, *goavro.Codec, int, int) *Subscription
+	NewTopic(string, *goavro.Codec, PublishSettings) Topic
+	NewSubscription(string, *goavro.Codec, ReceiveSettings) *Subscription
+	CreateTopicIfNotExists(context.Context, string) error
+	CreateSubscriptionIfNotExists(context.Context, string, string, string, int, bool) error
 	Close() error
 }
 
@@ -87,20 +125,80 @@ type pubsubClient struct {
 	client *pubsub.Client
 }
 
-// NewTopic retrieves the topic for publishing message. Using the default value if batchSize, numGoroutines, maxOutstanding <= 0
-func (c *pubsubClient) NewTopic(topicID string, codec *goavro.Codec, batchSize int, numGoroutines int, maxOutstanding int) Topic {
+// PublishSettings is the settings of batching and flow control of publishing messages, the zero values use the defaults of the client library
+type PublishSettings struct {
+	CountThreshold         int           // the max messages of a batch, default is 100
+	ByteThreshold          int           // the max bytes of a batch, default is 1e6
+	DelayThreshold         time.Duration // the max time to wait for a batch to be full, default is 10ms
+	NumGoroutines          int           // default is 25 * GOMAXPROCS
+	Timeout                time.Duration // the timeout of publishing a batch, default is 60s
+	BufferedByteLimit      int           // the max bytes buffered for publishing, default is 10 * MaxPublishRequestBytes
+	MaxOutstandingMessages int           // the flow control limit of the messages being published, default is 1000, negative for no limit
+	MaxOutstandingBytes    int           // the flow control limit of the bytes being published, default is no limit
+	LimitExceededBehavior  string        // block, ignore or signal-error when the flow control limits are exceeded, default is block
+}
+
+// limitExceededBehaviors are the flow control behaviors keyed by their names
+var limitExceededBehaviors = map[string]pubsub.LimitExceededBehavior{
+	"":             pubsub.FlowControlBlock,
+	"block":        pubsub.FlowControlBlock,
+	"ignore":       pubsub.FlowControlIgnore,
+	"signal-error": pubsub.FlowControlSignalError,
+}
+
+// Validate checks the settings against each other, the client library would silently clamp or ignore the conflicting ones
+func (s PublishSettings) Validate() error {
+	if s.CountThreshold < 0 || s.ByteThreshold < 0 || s.DelayThreshold < 0 || s.NumGoroutines < 0 || s.Timeout < 0 || s.BufferedByteLimit < 0 {
+		return fmt.Errorf("the publish settings must not be negative except the flow control limits: %+v", s)
+	}
+	if _, ok := limitExceededBehaviors[s.LimitExceededBehavior]; !ok {
+		return fmt.Errorf("unknown limit exceeded behavior: %v, block, ignore or signal-error is expected", s.LimitExceededBehavior)
+	}
+	if s.ByteThreshold > pubsub.MaxPublishRequestBytes {
+		return fmt.Errorf("the byte threshold %v is greater than the max publish request bytes %v", s.ByteThreshold, pubsub.MaxPublishRequestBytes)
+	}
+	if s.ByteThreshold > 0 && s.BufferedByteLimit > 0 && s.ByteThreshold > s.BufferedByteLimit {
+		return fmt.Errorf("the byte threshold %v is greater than the buffered byte limit %v", s.ByteThreshold, s.BufferedByteLimit)
+	}
+	if s.ByteThreshold > 0 && s.MaxOutstandingBytes > 0 && s.ByteThreshold > s.MaxOutstandingBytes {
+		return fmt.Errorf("the byte threshold %v is greater than the max outstanding bytes %v, the batch can never be full", s.ByteThreshold, s.MaxOutstandingBytes)
+	}
+	if s.CountThreshold > 0 && s.MaxOutstandingMessages > 0 && s.CountThreshold > s.MaxOutstandingMessages {
+		return fmt.Errorf("the count threshold %v is greater than the max outstanding messages %v, the batch can never be full", s.CountThreshold, s.MaxOutstandingMessages)
+	}
+	return nil
+}
+
+// NewTopic retrieves the topic for publishing message. Using the default value of the zero settings
+func (c *pubsubClient) NewTopic(topicID string, codec *goavro.Codec, settings PublishSettings) Topic {
 	topic := c.client.Topic(topicID)
 
-	if batchSize > 0 {
-		topic.PublishSettings.CountThreshold = batchSize
+	if settings.CountThreshold > 0 {
+		topic.PublishSettings.CountThreshold = settings.CountThreshold
+	}
+	if settings.ByteThreshold > 0 {
+		topic.PublishSettings.ByteThreshold = settings.ByteThreshold
+	}
+	if settings.DelayThreshold > 0 {
+		topic.PublishSettings.DelayThreshold = settings.DelayThreshold
+	}
+	if settings.NumGoroutines > 0 {
+		topic.PublishSettings.NumGoroutines = settings.NumGoroutines
+	}
+	if settings.Timeout > 0 {
+		topic.PublishSettings.Timeout = settings.Timeout
+	}
+	if settings.BufferedByteLimit > 0 {
+		topic.PublishSettings.BufferedByteLimit = settings.BufferedByteLimit
 	}
-	if numGoroutines > 0 {
-		topic.PublishSettings.NumGoroutines = numGoroutines // default is 25 * GOMAXPROCS
+	if settings.MaxOutstandingMessages != 0 {
+		topic.PublishSettings.FlowControlSettings.MaxOutstandingMessages = settings.MaxOutstandingMessages
 	}
-	topic.PublishSettings.FlowControlSettings.LimitExceededBehavior = pubsub.FlowControlBlock
-	if maxOutstanding > 0 {
-		topic.PublishSettings.FlowControlSettings.MaxOutstandingMessages = maxOutstanding
+	if settings.MaxOutstandingBytes != 0 {
+		topic.PublishSettings.FlowControlSettings.MaxOutstandingBytes = settings.MaxOutstandingBytes
 	}
+	topic.PublishSettings.FlowControlSettings.LimitExceededBehavior = limitExceededBehaviors[settings.LimitExceededBehavior]
+	slog.Info("publish settings", logging.Topic, topicID, "settings", fmt.Sprintf("%+v", topic.PublishSettings))
 	return &pubsubTopic{
 		id:    topicID,
 		topic: topic,
@@ -108,32 +206,180 @@ func (c *pubsubClient) NewTopic(topicID string, codec *goavro.Codec, batchSize i
 	}
 }
 
-// NewSubscription retrieves the subscription for receiving message. Using the default value if maxOutstanding, numGoroutines <= 0
-func (c *pubsubClient) NewSubscription(ID string, codec *goavro.Codec, numGoroutines int, maxOutstanding int) *Subscription {
+// ReceiveSettings is the settings of receiving messages, the zero values use the defaults of the client library
+type ReceiveSettings struct {
+	NumGoroutines          int           // default is 10, it is ignored by synchronous pull
+	MaxOutstandingMessages int           // default is 1000, negative for no limit
+	MaxOutstandingBytes    int           // default is 1e9, negative for no limit
+	MaxExtension           time.Duration // the max time to extend the ack deadline of a message, default is 60 minutes, negative to disable the extension
+	MaxExtensionPeriod     time.Duration // the max ack deadline of each extension, default is up to 10 minutes by the 99th percentile of the ack latency
+	MinExtensionPeriod     time.Duration // the min ack deadline of each extension, default is 10 seconds or 1 minute with exactly-once delivery
+	Synchronous            bool          // use synchronous pull instead of streaming pull, it does not work with exactly-once delivery
+}
+
+// The range of the ack deadline accepted by Cloud Pub/Sub
+const (
+	minAckDeadline = 10 * time.Second
+	maxAckDeadline = 600 * time.Second
+)
+
+// Validate checks the settings against each other, the client library would silently clamp or ignore the conflicting ones
+func (s ReceiveSettings) Validate() error {
+	if s.NumGoroutines < 0 || s.MaxExtensionPeriod < 0 || s.MinExtensionPeriod < 0 {
+		return fmt.Errorf("the number of goroutines and the extension periods must not be negative: %+v", s)
+	}
+	for _, period := range []time.Duration{s.MinExtensionPeriod, s.MaxExtensionPeriod} {
+		if period != 0 && (period < minAckDeadline || period > maxAckDeadline) {
+			return fmt.Errorf("the extension period %v is out of the ack deadline range [%v, %v]", period, minAckDeadline, maxAckDeadline)
+		}
+	}
+	if s.MinExtensionPeriod != 0 && s.MaxExtensionPeriod != 0 && s.MinExtensionPeriod > s.MaxExtensionPeriod {
+		return fmt.Errorf("the min extension period %v is greater than the max extension period %v", s.MinExtensionPeriod, s.MaxExtensionPeriod)
+	}
+	if s.MaxExtension > 0 && s.MaxExtensionPeriod > s.MaxExtension {
+		return fmt.Errorf("the max extension period %v is greater than the max extension %v", s.MaxExtensionPeriod, s.MaxExtension)
+	}
+	if s.MaxExtension < 0 && (s.MinExtensionPeriod != 0 || s.MaxExtensionPeriod != 0) {
+		return fmt.Errorf("the extension periods are set but the extension is disabled by the negative max extension %v", s.MaxExtension)
+	}
+	if s.Synchronous && s.NumGoroutines > 0 {
+		return fmt.Errorf("the number of goroutines %v is ignored by synchronous pull", s.NumGoroutines)
+	}
+	return nil
+}
+
+// NewSubscription retrieves the subscription for receiving message. Using the default value of the zero settings
+func (c *pubsubClient) NewSubscription(ID string, codec *goavro.Codec, settings ReceiveSettings) *Subscription {
 	sub := c.client.Subscription(ID)
 
-	if numGoroutines > 0 {
-		sub.ReceiveSettings.NumGoroutines = numGoroutines // default is 10
+	if settings.NumGoroutines > 0 {
+		sub.ReceiveSettings.NumGoroutines = settings.NumGoroutines
+	}
+	if settings.MaxOutstandingMessages != 0 {
+		sub.ReceiveSettings.MaxOutstandingMessages = settings.MaxOutstandingMessages
+	}
+	if settings.MaxOutstandingBytes != 0 {
+		sub.ReceiveSettings.MaxOutstandingBytes = settings.MaxOutstandingBytes
+	}
+	if settings.MaxExtension != 0 {
+		sub.ReceiveSettings.MaxExtension = settings.MaxExtension
+	}
+	if settings.MaxExtensionPeriod > 0 {
+		sub.ReceiveSettings.MaxExtensionPeriod = settings.MaxExtensionPeriod
 	}
-	if maxOutstanding > 0 {
-		sub.ReceiveSettings.MaxOutstandingMessages = maxOutstanding
+	if settings.MinExtensionPeriod > 0 {
+		sub.ReceiveSettings.MinExtensionPeriod = settings.MinExtensionPeriod
 	}
+	sub.ReceiveSettings.Synchronous = settings.Synchronous
+	slog.Info("receive settings", logging.Subscription, ID, "settings", fmt.Sprintf("%+v", sub.ReceiveSettings))
 	return &Subscription{
 		ID:           ID,
 		subscription: sub,
 		codec:        codec,
+		revisions:    map[string]*revision{},
+		sampler:      new(logging.Sampler),
+		leaseLimit:   leaseLimitOf(settings),
+		ackDeadline:  DefaultAckDeadline,
+		exactlyOnce:  true,
+	}
+}
+
+// DefaultAckDeadline is the ack deadline of the subscription if it is not set
+const DefaultAckDeadline = 10 * time.Second
+
+// leaseLimitOf returns the time a pulled message can be held before it is redelivered.
+// It is not the ack deadline of the subscription, since the client library keeps extending the ack deadline until the max extension, 60 minutes by default.
+// It is the default ack deadline if the extension is disabled.
+func leaseLimitOf(settings ReceiveSettings) time.Duration {
+	switch {
+	case settings.MaxExtension > 0:
+		return settings.MaxExtension
+	case settings.MaxExtension == 0:
+		return pubsub.DefaultReceiveSettings.MaxExtension
+	default:
+		return DefaultAckDeadline
+	}
+}
+
+// CreateTopicIfNotExists creates the topic if it does not exist yet
+func (c *pubsubClient) CreateTopicIfNotExists(ctx context.Context, topicID string) error {
+	exists, err := c.client.Topic(topicID).Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("fail to check topic: %v, err: %w", topicID, err)
+	}
+	if exists {
+		return nil
+	}
+	slog.Info("create topic", logging.Topic, topicID)
+	if _, err := c.client.CreateTopic(ctx, topicID); err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("fail to create topic: %v, err: %w", topicID, err)
+	}
+	return nil
+}
+
+// CreateSubscriptionIfNotExists creates the subscription of the topic if it does not exist yet.
+// The messages will be forwarded to the dead letter topic after maxDeliveryAttempts if deadLetterTopicID is not empty.
+func (c *pubsubClient) CreateSubscriptionIfNotExists(ctx context.Context, ID string, topicID string, deadLetterTopicID string, maxDeliveryAttempts int, exactlyOnce bool) error {
+	exists, err := c.client.Subscription(ID).Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("fail to check subscription: %v, err: %w", ID, err)
+	}
+	if exists {
+		return nil
+	}
+	cfg := pubsub.SubscriptionConfig{
+		Topic:                     c.client.Topic(topicID),
+		EnableExactlyOnceDelivery: exactlyOnce,
+	}
+	if deadLetterTopicID != "" {
+		cfg.DeadLetterPolicy = &pubsub.DeadLetterPolicy{
+			DeadLetterTopic:     c.client.Topic(deadLetterTopicID).String(),
+			MaxDeliveryAttempts: maxDeliveryAttempts,
+		}
+	}
+	slog.Info("create subscription", logging.Subscription, ID, logging.Topic, topicID, "dead_letter_topic", deadLetterTopicID, "max_delivery_attempts", maxDeliveryAttempts, "exactly_once", exactlyOnce)
+	if _, err := c.client.CreateSubscription(ctx, ID, cfg); err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("fail to create subscription: %v, err: %w", ID, err)
+	}
+	return nil
+}
+
+// permanentCodes are the codes of the errors can not be fixed by retrying, e.g. the subscription does not exist
+var permanentCodes = map[codes.Code]bool{
+	codes.NotFound:         true,
+	codes.PermissionDenied: true,
+	codes.Unauthenticated:  true,
+	codes.InvalidArgument:  true,
+}
+
+// IsPermanent reports whether the error of Cloud Pub/Sub can not be fixed by retrying
+func IsPermanent(err error) bool {
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		return false
+	}
+	return permanentCodes[se.GRPCStatus().Code()]
+}
+
+// NewBackoff creates the capped exponential backoff with full jitter, its Pause returns the next time to wait
+func NewBackoff(initial time.Duration, max time.Duration) *gax.Backoff {
+	return &gax.Backoff{
+		Initial:    initial,
+		Max:        max,
+		Multiplier: 2,
 	}
 }
 
 // Closes the underlying client.
 func (c *pubsubClient) Close() error {
-	log.Printf("close client: %v", c.client)
+	slog.Info("close client", "project", config.Config.Project)
 	return c.client.Close()
 }
 
 // Topic is used to publish message to topic
 type Topic interface {
 	Publish(context.Context, map[string]interface{}) (string, error)
+	PublishRaw(context.Context, []byte, map[string]string) (string, error)
 	GetID() string
 	Stop()
 }
@@ -154,18 +400,36 @@ func (t *pubsubTopic) Publish(ctx context.Context, data map[string]interface{})
 	if err != nil {
 		return "", fmt.Errorf("ignore invalid message: %v", data)
 	}
+	return t.publish(ctx, &pubsub.Message{
+		Data:       json,
+		Attributes: map[string]string{},
+	})
+}
+
+// PublishRaw publishes the data has been encoded already with the given attributes, e.g. to forward a received message as is
+func (t *pubsubTopic) PublishRaw(ctx context.Context, data []byte, attributes map[string]string) (string, error) {
 	msg := &pubsub.Message{
-		Data: json,
+		Data:       data,
+		Attributes: map[string]string{},
 	}
+	for k, v := range attributes {
+		msg.Attributes[k] = v
+	}
+	return t.publish(ctx, msg)
+}
+
+func (t *pubsubTopic) publish(ctx context.Context, msg *pubsub.Message) (string, error) {
+	// Propagate the trace context to the subscribers
+	tracing.Inject(ctx, msg.Attributes)
 	now := time.Now()
 	// Publish the encoded message to the topic
 	result := t.topic.Publish(ctx, msg)
 	// Wait and get the result of publishing
 	id, err := result.Get(ctx)
 	elapsed := time.Since(now)
-	log.Printf("publish message id: %v, elapsed: %v", id, elapsed)
+	logging.FromContext(ctx).Debug("published message", logging.Topic, t.id, "published_message_id", id, "elapsed", elapsed)
 	if err != nil {
-		return id, fmt.Errorf("fail to publish message: %v to topic: %v, err: %w", json, t.topic, err)
+		return id, fmt.Errorf("fail to publish message to topic: %s, err: %w", t.id, err)
 	}
 	return id, nil
 }
@@ -175,24 +439,176 @@ func (t *pubsubTopic) GetID() string {
 }
 
 func (t *pubsubTopic) Stop() {
-	log.Printf("stop topic: %v", t.GetID())
+	slog.Info("stop topic", logging.Topic, t.GetID())
 	t.topic.Stop()
 }
 
+// MaxAttributeValueSize is the max size in bytes of a message attribute value accepted by Cloud Pub/Sub
+const MaxAttributeValueSize = 1024
+
+// SchemaRevisionAttribute is the message attribute set by Cloud Pub/Sub with the schema revision ID used to publish the message
+const SchemaRevisionAttribute = "googclient_schemarevisionid"
+
 // Subscription is used to receive message
 type Subscription struct {
 	ID           string
 	subscription *pubsub.Subscription
-	codec        *goavro.Codec
+	codec        *goavro.Codec        // the reader codec, the handler always gets message data in this schema
+	revisions    map[string]*revision // the writer schemas keyed by schema revision ID
+	sampler      *logging.Sampler     // samples the logs of received messages
+	onDecodeErr  MessageErrorHandler  // handles the messages can not be decoded, nacks them if it is nil
+	leaseLimit   time.Duration        // the time a message can be held before it is redelivered
+	ackDeadline  time.Duration        // the ack deadline of the subscription, read from Cloud Pub/Sub when Receive starts
+	exactlyOnce  bool                 // whether the subscription enables exactly-once delivery, it is assumed until read from Cloud Pub/Sub when Receive starts
+}
+
+// SetLeaseLimit sets the time a message can be held before it is redelivered, e.g. the ack deadline of the push subscription which can not be extended
+func (sub *Subscription) SetLeaseLimit(leaseLimit time.Duration) {
+	sub.leaseLimit = leaseLimit
+}
+
+// SetAckDeadline sets the ack deadline of the subscription, e.g. the ack deadline of the push subscription which is not read by Receive
+func (sub *Subscription) SetAckDeadline(ackDeadline time.Duration) {
+	sub.ackDeadline = ackDeadline
+}
+
+// loadConfig reads the ack deadline and the exactly-once delivery of the subscription.
+// The defaults are kept if it can not be read, e.g. the subscriber role does not grant pubsub.subscriptions.get, so the ack results are still waited for.
+// The lease of the message is not extended if the max extension is negative, so the lease limit is the ack deadline as well.
+func (sub *Subscription) loadConfig(ctx context.Context) {
+	cfg, err := sub.subscription.Config(ctx)
+	if err != nil {
+		slog.Warn("fail to read subscription config, use the default ack deadline and wait for the ack results", logging.Subscription, sub.ID, "ack_deadline", sub.ackDeadline, "err", err)
+		return
+	}
+	sub.ackDeadline = cfg.AckDeadline
+	sub.exactlyOnce = cfg.EnableExactlyOnceDelivery
+	if sub.subscription.ReceiveSettings.MaxExtension < 0 {
+		sub.leaseLimit = cfg.AckDeadline
+	}
+}
+
+type revision struct {
+	codec    *goavro.Codec
+	resolver *avro.Resolver
+}
+
+// AddRevision adds the codec of the given schema revision for decoding messages published with that revision.
+// The decoded data is converted to the schema of the subscription codec using avro schema resolution.
+func (sub *Subscription) AddRevision(revisionID string, codec *goavro.Codec) error {
+	resolver, err := avro.NewResolver(codec, sub.codec)
+	if err != nil {
+		return fmt.Errorf("fail to add schema revision %v, err: %w", revisionID, err)
+	}
+	sub.revisions[revisionID] = &revision{codec: codec, resolver: resolver}
+	return nil
+}
+
+// decode decodes the message data using the codec of its schema revision, and then resolves it to the subscription codec.
+// The subscription codec is used directly if the schema revision of the message is unknown.
+func (sub *Subscription) decode(pubsubMessage *pubsub.Message) (map[string]interface{}, error) {
+	revisionID := pubsubMessage.Attributes[SchemaRevisionAttribute]
+	rev, ok := sub.revisions[revisionID]
+	if !ok {
+		return avro.DecodeFromJSON(sub.codec, pubsubMessage.Data)
+	}
+	data, err := avro.DecodeFromJSON(rev.codec, pubsubMessage.Data)
+	if err != nil {
+		return nil, err
+	}
+	return rev.resolver.ResolveRecord(data)
 }
 
 // MessageHandler is the function to handle the received message
 type MessageHandler func(context.Context, *Message)
 
+// MessageErrorHandler is the function to handle the message failed to be processed, Data of the message may be nil
+type MessageErrorHandler func(context.Context, *Message, error)
+
+// OnDecodeError sets the handler of the messages can not be decoded instead of nacking them
+func (sub *Subscription) OnDecodeError(handler MessageErrorHandler) {
+	sub.onDecodeErr = handler
+}
+
 // Message contains the message content decoded by avro schema
 type Message struct {
 	*pubsub.Message
-	Data map[string]interface{}
+	Data        map[string]interface{}
+	ctx         context.Context      // the context of Receive, used to wait for the ack result
+	settle      func(ack bool) error // acks or nacks the pushed message instead of the client library, nil for the pulled message
+	leaseEnd    time.Time            // the message will be redelivered after it if it is not acked
+	ackDeadline time.Duration        // the ack deadline of the subscription
+	exactlyOnce bool                 // whether to wait for the ack result, it is only known with exactly-once delivery
+}
+
+// AckDeadline returns the ack deadline of the subscription.
+// The client library extends the ack deadline of the pulled message until its lease deadline, see LeaseDeadline.
+func (m *Message) AckDeadline() time.Duration {
+	return m.ackDeadline
+}
+
+// LeaseDeadline returns the time the message will be redelivered if it is not acked or nacked before it.
+// For the pulled message it is the end of the lease extension given by the max extension, not the ack deadline of the subscription, see AckDeadline.
+// For the pushed message it is the ack deadline of the push subscription.
+// It is counted from when the handler got the message, so the message may be redelivered a little earlier if it waited for the flow control.
+func (m *Message) LeaseDeadline() time.Time {
+	return m.leaseEnd
+}
+
+// LeaseTimeLeft returns the time left before the lease deadline of the message
+func (m *Message) LeaseTimeLeft() time.Duration {
+	return time.Until(m.leaseEnd)
+}
+
+// Ack acknowledges the message, and waits for the result if exactly-once delivery is enabled on the subscription.
+// The result is only known with exactly-once delivery, otherwise the ack is sent in the background and it always succeeds.
+// The client library retries the transient failures already, so the returned error means the message will be redelivered, e.g. the ack ID is expired.
+func (m *Message) Ack() error {
+	if m.settle != nil {
+		return m.settle(true)
+	}
+	if !m.exactlyOnce {
+		m.Message.Ack()
+		return nil
+	}
+	return m.wait("ack", m.Message.AckWithResult())
+}
+
+// Nack negatively acknowledges the message, the same with Ack
+func (m *Message) Nack() error {
+	if m.settle != nil {
+		return m.settle(false)
+	}
+	if !m.exactlyOnce {
+		m.Message.Nack()
+		return nil
+	}
+	return m.wait("nack", m.Message.NackWithResult())
+}
+
+func (m *Message) wait(action string, result *pubsub.AckResult) error {
+	status, err := result.Get(m.ctx)
+	if err != nil {
+		return fmt.Errorf("fail to %v message: %v, status: %v, err: %w", action, m.ID, ackStatuses[status], err)
+	}
+	return nil
+}
+
+// ackStatuses are the names of the ack result status for logging
+var ackStatuses = map[pubsub.AcknowledgeStatus]string{
+	pubsub.AcknowledgeStatusSuccess:            "success",
+	pubsub.AcknowledgeStatusPermissionDenied:   "permission denied",
+	pubsub.AcknowledgeStatusFailedPrecondition: "failed precondition",
+	pubsub.AcknowledgeStatusInvalidAckID:       "invalid ack ID",
+	pubsub.AcknowledgeStatusOther:              "other",
+}
+
+// Attempt returns the delivery attempt of the message, it is 0 if the subscription does not have a dead letter policy
+func (m *Message) Attempt() int {
+	if m.DeliveryAttempt == nil {
+		return 0
+	}
+	return *m.DeliveryAttempt
 }
 
 // Receive starts to receive messages.
@@ -202,18 +618,53 @@ type Message struct {
 func (sub *Subscription) Receive(ctx context.Context, handler MessageHandler) error {
 	// handler: the callback function to handle the received message
 
+	sub.loadConfig(ctx)
 	return sub.subscription.Receive(ctx, func(ctx context.Context, pubsubMessage *pubsub.Message) {
-		log.Printf("got Cloud Pub/Sub message ID: %v", pubsubMessage.ID)
-		data, err := avro.DecodeFromJSON(sub.codec, pubsubMessage.Data)
-		if err != nil {
-			log.Printf("failed to check schema, message: %v, ", pubsubMessage.ID)
-			pubsubMessage.Nack()
+		sub.handle(ctx, pubsubMessage, nil, handler)
+	})
+}
+
+// handle decodes the pulled or pushed message and calls the handler with it, settle is nil for the pulled message
+func (sub *Subscription) handle(ctx context.Context, pubsubMessage *pubsub.Message, settle func(bool) error, handler MessageHandler) {
+	// The logger of the message is carried by ctx, so that the handler logs with the same attributes and sampling
+	attrs := []any{logging.Subscription, sub.ID, logging.MessageID, pubsubMessage.ID}
+	if pubsubMessage.DeliveryAttempt != nil {
+		attrs = append(attrs, logging.Attempt, *pubsubMessage.DeliveryAttempt)
+	}
+	logger := sub.sampler.Logger(slog.Default()).With(attrs...)
+	ctx = logging.NewContext(ctx, logger)
+	logger.Debug("got Cloud Pub/Sub message")
+
+	// The spans of the handler are the children of the receive span, which continues the trace of the publisher
+	ctx, span := tracing.Start(tracing.Extract(ctx, pubsubMessage.Attributes), sub.ID+" receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.message_id", pubsubMessage.ID)))
+	defer span.End()
+
+	message := &Message{
+		Message:     pubsubMessage,
+		ctx:         ctx,
+		settle:      settle,
+		leaseEnd:    time.Now().Add(sub.leaseLimit),
+		ackDeadline: sub.ackDeadline,
+		exactlyOnce: sub.exactlyOnce,
+	}
+	_, decodeSpan := tracing.Start(ctx, "decode")
+	data, err := sub.decode(pubsubMessage)
+	tracing.End(decodeSpan, err)
+	if err != nil {
+		logger.Error("failed to check schema", "revision", pubsubMessage.Attributes[SchemaRevisionAttribute], "err", err)
+		if sub.onDecodeErr != nil {
+			sub.onDecodeErr(ctx, message, fmt.Errorf("fail to decode message, err: %w", err))
 			return
 		}
-		message := &Message{
-			Message: pubsubMessage,
-			Data:    data,
+		if settle != nil {
+			settle(false) // nolint: errcheck
+			return
 		}
-		handler(ctx, message)
-	})
+		pubsubMessage.Nack()
+		return
+	}
+	message.Data = data
+	handler(ctx, message)
 }
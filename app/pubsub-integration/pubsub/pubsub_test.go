@@ -0,0 +1,201 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"google/jss/pubsub-integration/pubsub/config"
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestReceiveSettingsValidate(t *testing.T) {
+	valid := []ReceiveSettings{
+		{},
+		{NumGoroutines: 1, MaxOutstandingMessages: -1, MaxOutstandingBytes: -1},
+		{MaxExtension: time.Minute, MinExtensionPeriod: 10 * time.Second, MaxExtensionPeriod: time.Minute},
+		{MaxExtension: -1},
+		{Synchronous: true, MaxOutstandingMessages: 10},
+	}
+	for _, s := range valid {
+		assert.Nil(t, s.Validate(), "%+v", s)
+	}
+
+	invalid := []ReceiveSettings{
+		{NumGoroutines: -1},
+		{MinExtensionPeriod: time.Second},
+		{MaxExtensionPeriod: 20 * time.Minute},
+		{MinExtensionPeriod: time.Minute, MaxExtensionPeriod: 30 * time.Second},
+		{MaxExtension: 30 * time.Second, MaxExtensionPeriod: time.Minute},
+		{MaxExtension: -1, MinExtensionPeriod: time.Minute},
+		{Synchronous: true, NumGoroutines: 2},
+	}
+	for _, s := range invalid {
+		assert.NotNil(t, s.Validate(), "%+v", s)
+	}
+}
+
+func TestPublishSettingsValidate(t *testing.T) {
+	valid := []PublishSettings{
+		{},
+		{CountThreshold: 100, MaxOutstandingMessages: 100, LimitExceededBehavior: "block"},
+		{ByteThreshold: 1e6, BufferedByteLimit: 1e7, MaxOutstandingBytes: 1e7, LimitExceededBehavior: "signal-error"},
+		{DelayThreshold: time.Second, Timeout: time.Minute, MaxOutstandingMessages: -1, MaxOutstandingBytes: -1, LimitExceededBehavior: "ignore"},
+	}
+	for _, s := range valid {
+		assert.Nil(t, s.Validate(), "%+v", s)
+	}
+
+	invalid := []PublishSettings{
+		{CountThreshold: -1},
+		{DelayThreshold: -time.Second},
+		{LimitExceededBehavior: "drop"},
+		{ByteThreshold: 2e7},
+		{ByteThreshold: 1e6, BufferedByteLimit: 1e5},
+		{ByteThreshold: 1e6, MaxOutstandingBytes: 1e5},
+		{CountThreshold: 100, MaxOutstandingMessages: 10},
+	}
+	for _, s := range invalid {
+		assert.NotNil(t, s.Validate(), "%+v", s)
+	}
+}
+
+// The lease of the message ends at the max extension, or the ack deadline if the extension is disabled
+func TestLeaseLimit(t *testing.T) {
+	assert.Equal(t, time.Hour, leaseLimitOf(ReceiveSettings{}))
+	assert.Equal(t, time.Minute, leaseLimitOf(ReceiveSettings{MaxExtension: time.Minute}))
+	assert.Equal(t, DefaultAckDeadline, leaseLimitOf(ReceiveSettings{MaxExtension: -1}))
+
+	message := &Message{leaseEnd: time.Now().Add(time.Minute)}
+	assert.InDelta(t, time.Minute, message.LeaseTimeLeft(), float64(time.Second))
+}
+
+// The ack deadline of the message is read from the subscription, it is the lease limit as well if the extension is disabled
+func TestAckDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := pstest.NewServer()
+	t.Cleanup(func() { server.Close() }) // nolint: errcheck
+	conn, err := grpc.Dial(server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() }) // nolint: errcheck
+	client, err := NewClientWithOptions(ctx, "project", nil, option.WithGRPCConn(conn))
+	assert.Nil(t, err)
+	t.Cleanup(func() { client.Close() }) // nolint: errcheck
+
+	_, err = server.GServer.CreateTopic(ctx, &pb.Topic{Name: "projects/project/topics/topic"})
+	assert.Nil(t, err)
+	_, err = server.GServer.CreateSubscription(ctx, &pb.Subscription{
+		Name:               "projects/project/subscriptions/subscription",
+		Topic:              "projects/project/topics/topic",
+		AckDeadlineSeconds: 30,
+	})
+	assert.Nil(t, err)
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "Event", "fields": [{"name": "id", "type": "string"}]}`)
+	assert.Nil(t, err)
+	topic := client.NewTopic("topic", codec, PublishSettings{})
+	defer topic.Stop()
+	_, err = topic.Publish(ctx, map[string]interface{}{"id": "1"})
+	assert.Nil(t, err)
+
+	sub := client.NewSubscription("subscription", codec, ReceiveSettings{MaxExtension: -1})
+	received := make(chan *Message, 1)
+	go sub.Receive(ctx, func(_ context.Context, message *Message) { // nolint: errcheck
+		message.Ack() // nolint: errcheck
+		received <- message
+		cancel()
+	})
+	message := <-received
+	assert.Equal(t, 30*time.Second, message.AckDeadline())
+	assert.InDelta(t, 30*time.Second, message.LeaseTimeLeft(), float64(time.Second))
+}
+
+// The ack result is only waited for if the subscription enables exactly-once delivery
+func TestExactlyOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := pstest.NewServer()
+	t.Cleanup(func() { server.Close() }) // nolint: errcheck
+	conn, err := grpc.Dial(server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() }) // nolint: errcheck
+	client, err := NewClientWithOptions(ctx, "project", nil, option.WithGRPCConn(conn))
+	assert.Nil(t, err)
+	t.Cleanup(func() { client.Close() }) // nolint: errcheck
+
+	_, err = server.GServer.CreateTopic(ctx, &pb.Topic{Name: "projects/project/topics/topic"})
+	assert.Nil(t, err)
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "Event", "fields": [{"name": "id", "type": "string"}]}`)
+	assert.Nil(t, err)
+	topic := client.NewTopic("topic", codec, PublishSettings{})
+	defer topic.Stop()
+
+	for _, exactlyOnce := range []bool{false, true} {
+		ID := fmt.Sprintf("subscription-%v", exactlyOnce)
+		_, err = server.GServer.CreateSubscription(ctx, &pb.Subscription{
+			Name:                      "projects/project/subscriptions/" + ID,
+			Topic:                     "projects/project/topics/topic",
+			EnableExactlyOnceDelivery: exactlyOnce,
+		})
+		assert.Nil(t, err)
+	}
+	_, err = topic.Publish(ctx, map[string]interface{}{"id": "1"})
+	assert.Nil(t, err)
+
+	for _, exactlyOnce := range []bool{false, true} {
+		sub := client.NewSubscription(fmt.Sprintf("subscription-%v", exactlyOnce), codec, ReceiveSettings{})
+		receiveCtx, stop := context.WithCancel(ctx)
+		acked := make(chan error, 1)
+		var message *Message
+		go sub.Receive(receiveCtx, func(_ context.Context, m *Message) { // nolint: errcheck
+			message = m
+			acked <- m.Ack()
+			stop()
+		})
+		assert.Nil(t, <-acked, exactlyOnce)
+		assert.Equal(t, exactlyOnce, message.exactlyOnce)
+	}
+}
+
+// The emulator host given by the config rather than the environment is used, and the project is required
+func TestNewClientEmulator(t *testing.T) {
+	server := pstest.NewServer()
+	t.Cleanup(func() { server.Close() }) // nolint: errcheck
+	prev := config.Config
+	t.Cleanup(func() { config.Config = prev })
+	t.Setenv("PUBSUB_EMULATOR_HOST", "")
+
+	config.Config.EmulatorHost = server.Addr
+	config.Config.Project = ""
+	_, err := Service.NewClient(context.Background(), nil)
+	assert.ErrorContains(t, err, "GOOGLE_CLOUD_PROJECT is required")
+
+	config.Config.Project = "emulator"
+	client, err := Service.NewClient(context.Background(), nil)
+	assert.Nil(t, err)
+	defer client.Close() // nolint: errcheck
+	assert.Nil(t, client.CreateTopicIfNotExists(context.Background(), "topic"))
+	_, err = server.GServer.GetTopic(context.Background(), &pb.GetTopicRequest{Topic: "projects/emulator/topics/topic"})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,239 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pubsubtest provides an in-memory implementation of pubsub.Service for testing
+package pubsubtest
+
+import (
+	"context"
+	"errors"
+	"google/jss/pubsub-integration/logging"
+	"google/jss/pubsub-integration/pubsub"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub"
+	pb "cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Project is the project ID of the clients created by the fake service
+const Project = "pubsubtest"
+
+// Service is the in-memory Cloud Pub/Sub service backed by the pstest fake server.
+// It records the published messages, and can be scripted to fail or delay the publishing.
+// Messages published to a topic are delivered to its subscriptions, so that Subscription.Receive works as usual.
+type Service struct {
+	Server *pstest.Server
+
+	mux       sync.Mutex
+	published map[string][]map[string]interface{} // the published message data keyed by topic ID
+	errors    map[string][]error                  // the scripted publish errors keyed by topic ID
+	latency   map[string]time.Duration            // the scripted publish latency keyed by topic ID
+	schemas   map[string]*goavro.Codec            // the schemas enforced by the topics keyed by topic ID
+}
+
+// NewService starts the fake server and creates the service.
+// Set it to pubsub.Service to replace the real Cloud Pub/Sub.
+// The options can inject errors into the RPCs other than publish, e.g. Acknowledge.
+// Like Cloud Pub/Sub, the server rejects the published messages with too large attribute values,
+// and the messages not matching the schema of the topic, see SetSchema.
+func NewService(opts ...pstest.ServerReactorOption) *Service {
+	s := &Service{
+		published: map[string][]map[string]interface{}{},
+		errors:    map[string][]error{},
+		latency:   map[string]time.Duration{},
+		schemas:   map[string]*goavro.Codec{},
+	}
+	opts = append([]pstest.ServerReactorOption{
+		{FuncName: "Publish", Reactor: attributeLimit{}},
+		{FuncName: "Publish", Reactor: schemaCheck{service: s}},
+	}, opts...)
+	s.Server = pstest.NewServer(opts...)
+	return s
+}
+
+// Close shuts down the fake server
+func (s *Service) Close() error {
+	return s.Server.Close()
+}
+
+// NewClient creates the client connected to the fake server
+func (s *Service) NewClient(ctx context.Context, clientCfg *gpubsub.ClientConfig) (pubsub.Client, error) {
+	conn, err := grpc.Dial(s.Server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	client, err := pubsub.NewClientWithOptions(ctx, Project, clientCfg, option.WithGRPCConn(conn))
+	if err != nil {
+		conn.Close() // nolint: errcheck
+		return nil, err
+	}
+	return &fakeClient{Client: client, service: s, conn: conn}, nil
+}
+
+// Published returns the data of the messages have been published to the topic successfully
+func (s *Service) Published(topicID string) []map[string]interface{} {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]map[string]interface{}(nil), s.published[topicID]...)
+}
+
+// FailPublish makes the next publishing to the topic return the given errors in order
+func (s *Service) FailPublish(topicID string, errs ...error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.errors[topicID] = append(s.errors[topicID], errs...)
+}
+
+// SetPublishLatency delays every publishing to the topic by the given duration
+func (s *Service) SetPublishLatency(topicID string, latency time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.latency[topicID] = latency
+}
+
+// SetSchema makes the topic reject the messages which are not JSON encoded by the codec, like the topic with schema settings
+func (s *Service) SetSchema(topicID string, codec *goavro.Codec) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.schemas[topicID] = codec
+}
+
+func (s *Service) schema(topicID string) *goavro.Codec {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.schemas[topicID]
+}
+
+// beforePublish returns the scripted latency and error of the next publishing
+func (s *Service) beforePublish(topicID string) (time.Duration, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var err error
+	if errs := s.errors[topicID]; len(errs) > 0 {
+		err, s.errors[topicID] = errs[0], errs[1:]
+	}
+	return s.latency[topicID], err
+}
+
+func (s *Service) record(topicID string, data map[string]interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.published[topicID] = append(s.published[topicID], data)
+}
+
+// attributeLimit rejects the publish request if any attribute value exceeds the limit of Cloud Pub/Sub
+type attributeLimit struct{}
+
+func (attributeLimit) React(req interface{}) (bool, interface{}, error) {
+	for _, msg := range req.(*pb.PublishRequest).Messages {
+		for k, v := range msg.Attributes {
+			if len(v) > pubsub.MaxAttributeValueSize {
+				return false, nil, status.Errorf(codes.InvalidArgument, "the value of attribute %s exceeds %d bytes", k, pubsub.MaxAttributeValueSize)
+			}
+		}
+	}
+	return false, nil, nil
+}
+
+// schemaCheck rejects the publish request if any message does not match the schema of the topic
+type schemaCheck struct {
+	service *Service
+}
+
+func (c schemaCheck) React(req interface{}) (bool, interface{}, error) {
+	publish := req.(*pb.PublishRequest)
+	topicID := publish.Topic[strings.LastIndex(publish.Topic, "/")+1:]
+	codec := c.service.schema(topicID)
+	if codec == nil {
+		return false, nil, nil
+	}
+	for _, msg := range publish.Messages {
+		if _, _, err := codec.NativeFromTextual(msg.Data); err != nil {
+			return false, nil, status.Errorf(codes.InvalidArgument, "the message does not match the schema of topic %s: %v", topicID, err)
+		}
+	}
+	return false, nil, nil
+}
+
+type fakeClient struct {
+	pubsub.Client
+	service *Service
+	conn    *grpc.ClientConn // the connection to the fake server, it is not closed by the client library since it is given by the option
+}
+
+// Close closes the client and then the connection to the fake server
+func (c *fakeClient) Close() error {
+	return errors.Join(c.Client.Close(), c.conn.Close())
+}
+
+// NewTopic creates the topic on the fake server if it does not exist
+func (c *fakeClient) NewTopic(topicID string, codec *goavro.Codec, settings pubsub.PublishSettings) pubsub.Topic {
+	if err := c.CreateTopicIfNotExists(context.Background(), topicID); err != nil {
+		slog.Warn("fail to create topic", logging.Topic, topicID, "err", err)
+	}
+	return &fakeTopic{
+		Topic:   c.Client.NewTopic(topicID, codec, settings),
+		service: c.service,
+	}
+}
+
+type fakeTopic struct {
+	pubsub.Topic
+	service *Service
+}
+
+// Publish publishes the message after the scripted latency, or returns the scripted error
+func (t *fakeTopic) Publish(ctx context.Context, data map[string]interface{}) (string, error) {
+	if err := t.beforePublish(ctx); err != nil {
+		return "", err
+	}
+	id, err := t.Topic.Publish(ctx, data)
+	if err != nil {
+		return id, err
+	}
+	t.service.record(t.GetID(), data)
+	return id, nil
+}
+
+// PublishRaw publishes the raw message after the scripted latency, or returns the scripted error.
+// The raw messages are not recorded, they can be found on the fake server.
+func (t *fakeTopic) PublishRaw(ctx context.Context, data []byte, attributes map[string]string) (string, error) {
+	if err := t.beforePublish(ctx); err != nil {
+		return "", err
+	}
+	return t.Topic.PublishRaw(ctx, data, attributes)
+}
+
+// beforePublish waits for the scripted latency and returns the scripted error
+func (t *fakeTopic) beforePublish(ctx context.Context) error {
+	latency, err := t.service.beforePublish(t.GetID())
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
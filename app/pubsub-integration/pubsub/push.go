@@ -0,0 +1,179 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"google/jss/pubsub-integration/logging"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/idtoken"
+)
+
+// The headers of the unwrapped push request with the message metadata
+// https://cloud.google.com/pubsub/docs/payload-unwrapping
+const (
+	headerMessageID   = "X-Goog-Pubsub-Message-Id"
+	headerPublishTime = "X-Goog-Pubsub-Publish-Time"
+	headerOrderingKey = "X-Goog-Pubsub-Ordering-Key"
+)
+
+// transportHeaders are the headers of the push request rather than the message attributes, so they are not forwarded with the message
+var transportHeaders = map[string]bool{
+	"authorization":   true,
+	"accept-encoding": true,
+	"content-length":  true,
+	"content-type":    true,
+	"from":            true,
+	"user-agent":      true,
+}
+
+// PushConfig is the settings of the push endpoint
+type PushConfig struct {
+	Unwrapped bool          // the request body is the message data and the attributes are the headers, otherwise it is the JSON wrapping the message
+	Verify    TokenVerifier // verifies the OIDC token in the Authorization header, nil to accept any request
+}
+
+// TokenVerifier verifies the OIDC token of the push request
+type TokenVerifier func(context.Context, string) error
+
+// NewTokenVerifier creates the verifier of the Google-signed OIDC token for the audience.
+// The token must be issued to the service account of the push subscription if email is not empty.
+func NewTokenVerifier(audience string, email string) TokenVerifier {
+	return func(ctx context.Context, token string) error {
+		payload, err := idtoken.Validate(ctx, token, audience)
+		if err != nil {
+			return err
+		}
+		if email == "" {
+			return nil
+		}
+		if payload.Claims["email"] != email || payload.Claims["email_verified"] != true {
+			return fmt.Errorf("the token is not issued to %v", email)
+		}
+		return nil
+	}
+}
+
+// pushRequest is the JSON body of the wrapped push request
+// https://cloud.google.com/pubsub/docs/push#receive_push
+type pushRequest struct {
+	Message struct {
+		Data        []byte            `json:"data"` // base64 encoded
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+		OrderingKey string            `json:"orderingKey"`
+	} `json:"message"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt *int   `json:"deliveryAttempt"`
+}
+
+// PushHandler creates the HTTP handler of the push subscription.
+// It decodes the pushed message and calls the handler the same as Receive.
+// It responds 204 if the handler acks the message, or 500 so that Cloud Pub/Sub redelivers the message if the handler nacks it or returns without acking it.
+func (sub *Subscription) PushHandler(cfg PushConfig, handler MessageHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cfg.Verify != nil {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found {
+				http.Error(w, "missing bearer token", http.StatusUnauthorized)
+				return
+			}
+			if err := cfg.Verify(r.Context(), token); err != nil {
+				slog.Warn("invalid push token", logging.Subscription, sub.ID, "err", err)
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+		}
+		pubsubMessage, err := readPushMessage(r, cfg.Unwrapped)
+		if err != nil {
+			slog.Warn("invalid push request", logging.Subscription, sub.ID, "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The first ack or nack settles the message, the same as the client library
+		var once sync.Once
+		acked := false
+		settle := func(ack bool) error {
+			once.Do(func() { acked = ack })
+			return nil
+		}
+		sub.handle(r.Context(), pubsubMessage, settle, handler)
+		once.Do(func() {}) // the message is nacked if the handler does not settle it
+		if !acked {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// readPushMessage reads the message from the wrapped or unwrapped push request
+func readPushMessage(r *http.Request, unwrapped bool) (*pubsub.Message, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read push request, err: %w", err)
+	}
+	if !unwrapped {
+		var req pushRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, fmt.Errorf("fail to parse push request, err: %w", err)
+		}
+		return &pubsub.Message{
+			ID:              req.Message.MessageID,
+			Data:            req.Message.Data,
+			Attributes:      req.Message.Attributes,
+			PublishTime:     req.Message.PublishTime,
+			OrderingKey:     req.Message.OrderingKey,
+			DeliveryAttempt: req.DeliveryAttempt,
+		}, nil
+	}
+
+	// The attributes are written to the headers as they are, but the header names are case insensitive.
+	// The metadata headers and the headers added by the proxies are not attributes.
+	message := &pubsub.Message{
+		ID:          r.Header.Get(headerMessageID),
+		Data:        body,
+		Attributes:  map[string]string{},
+		OrderingKey: r.Header.Get(headerOrderingKey),
+	}
+	if publishTime := r.Header.Get(headerPublishTime); publishTime != "" {
+		if message.PublishTime, err = time.Parse(time.RFC3339Nano, publishTime); err != nil {
+			return nil, fmt.Errorf("invalid publish time: %v, err: %w", publishTime, err)
+		}
+	}
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if transportHeaders[name] || strings.HasPrefix(name, "x-goog-") || strings.HasPrefix(name, "x-forwarded-") || strings.HasPrefix(name, "x-cloud-") {
+			continue
+		}
+		message.Attributes[name] = r.Header.Get(name)
+	}
+	return message, nil
+}
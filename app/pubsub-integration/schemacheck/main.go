@@ -0,0 +1,77 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main is the entry point of the schema compatibility checker.
+//
+// Check the avro compatibility between two schema files:
+//
+//	schemacheck -compatibility full MetricsAck.avsc MetricsComplete.avsc
+//
+// Check an avro schema lines up with the BigQuery table JSON schema:
+//
+//	schemacheck -bigquery MetricsComplete.avsc bigquery/MetricsComplete.json
+//
+// The schemas under infra/config/avro are checked by the schemacheck step of build/lint.cloudbuild.yaml.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"google/jss/pubsub-integration/avro"
+	"log"
+	"os"
+)
+
+func main() {
+	compatibility := flag.String("compatibility", string(avro.Full), "the avro compatibility to check between OLD and NEW schema: backward, forward or full")
+	bigQuery := flag.Bool("bigquery", false, "check the avro schema against the BigQuery table JSON schema instead")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  %[1]v [-compatibility backward|forward|full] OLD.avsc NEW.avsc\n  %[1]v -bigquery SCHEMA.avsc TABLE.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	first, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("fail to read schema file, err: %v", err)
+	}
+	second, err := os.ReadFile(flag.Arg(1))
+	if err != nil {
+		log.Fatalf("fail to read schema file, err: %v", err)
+	}
+
+	var incompatibilities []avro.Incompatibility
+	if *bigQuery {
+		incompatibilities, err = avro.CheckBigQuery(string(first), string(second))
+	} else {
+		incompatibilities, err = avro.CheckCompatibility(string(first), string(second), avro.Compatibility(*compatibility))
+	}
+	if err != nil {
+		log.Fatalf("fail to check schema, err: %v", err)
+	}
+
+	if len(incompatibilities) == 0 {
+		fmt.Printf("%v and %v are compatible\n", flag.Arg(0), flag.Arg(1))
+		return
+	}
+	fmt.Printf("%v and %v are incompatible:\n", flag.Arg(0), flag.Arg(1))
+	for _, i := range incompatibilities {
+		fmt.Printf("  %v\n", i)
+	}
+	os.Exit(1)
+}
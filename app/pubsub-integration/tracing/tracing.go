@@ -0,0 +1,142 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing sets up OpenTelemetry tracing and propagates W3C trace context through message attributes.
+// The tracer provider is set up when the package is initialized, spans are dropped if TRACE_EXPORTER is off.
+// The OTLP exporter is configured by the standard OTEL_EXPORTER_OTLP_* environment variables,
+// and the service name by OTEL_SERVICE_NAME.
+// The OTLP spans are exported in batches, the mains call Shutdown before exiting so that the buffered spans are not dropped.
+package tracing
+
+import (
+	"context"
+	"google/jss/pubsub-integration/loader"
+	"google/jss/pubsub-integration/logging"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type config struct {
+	Exporter string `env:"TRACE_EXPORTER" default:"off" validate:"oneof=otlp stdout off"`
+}
+
+// Config is the tracing configuration parsed from defaults, config file, environment variables and flags.
+var Config config
+
+// The W3C trace context propagator
+var propagator = propagation.TraceContext{}
+
+// provider is the tracer provider set up by TRACE_EXPORTER, it is nil if tracing is off
+var provider *sdktrace.TracerProvider
+
+// FlushTimeout is the max time to wait for the buffered spans to be exported by Flush or Shutdown
+const FlushTimeout = 5 * time.Second
+
+func init() {
+	result, err := loader.Load(&Config)
+	if err != nil {
+		logging.Fatal("invalid config", "err", err)
+	}
+	slog.Info("using tracing config", "config", result)
+
+	if err := setup(context.Background()); err != nil {
+		logging.Fatal("fail to set up tracing", "err", err)
+	}
+}
+
+func setup(ctx context.Context) error {
+	otel.SetTextMapPropagator(propagator)
+
+	var opt sdktrace.TracerProviderOption
+	switch Config.Exporter {
+	case "otlp":
+		exporter, err := otlptracegrpc.New(ctx)
+		if err != nil {
+			return err
+		}
+		opt = sdktrace.WithBatcher(exporter)
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return err
+		}
+		opt = sdktrace.WithSyncer(exporter)
+	default:
+		return nil
+	}
+	provider = sdktrace.NewTracerProvider(opt, sdktrace.WithResource(resource.Default()))
+	otel.SetTracerProvider(provider)
+	return nil
+}
+
+// Flush exports the spans buffered by the batcher, e.g. when a run of the generator is finished
+func Flush() {
+	if provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), FlushTimeout)
+	defer cancel()
+	if err := provider.ForceFlush(ctx); err != nil {
+		slog.Warn("fail to flush spans", "err", err)
+	}
+}
+
+// Shutdown exports the buffered spans and stops the tracer provider, it is called before the process exits
+func Shutdown() {
+	if provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), FlushTimeout)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		slog.Warn("fail to shut down tracing, the buffered spans may be dropped", "err", err)
+	}
+}
+
+// Producer is the option of the spans publishing messages
+var Producer = trace.WithSpanKind(trace.SpanKindProducer)
+
+// Start starts a span as the child of the span in ctx
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer("google/jss/pubsub-integration").Start(ctx, name, opts...)
+}
+
+// End records the error if it is not nil and then ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject puts the trace context of ctx into the message attributes
+func Inject(ctx context.Context, attributes map[string]string) {
+	propagator.Inject(ctx, propagation.MapCarrier(attributes))
+}
+
+// Extract returns the context with the trace context of the message attributes as the remote parent
+func Extract(ctx context.Context, attributes map[string]string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(attributes))
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// The span started from the extracted context is the child of the span injected into the attributes
+func TestPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	ctx, publish := Start(context.Background(), "publish", Producer)
+	attributes := map[string]string{}
+	Inject(ctx, attributes)
+	End(publish, nil)
+	assert.NotEmpty(t, attributes["traceparent"])
+
+	_, receive := Start(Extract(context.Background(), attributes), "receive")
+	End(receive, errors.New("fail to decode"))
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, spans[0].SpanContext().TraceID(), spans[1].SpanContext().TraceID())
+	assert.Equal(t, spans[0].SpanContext().SpanID(), spans[1].Parent().SpanID())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
+
+// exporter records the exported span names, unlike tracetest.InMemoryExporter they are kept after shutdown
+type exporter struct {
+	mux   sync.Mutex
+	names []string
+}
+
+func (e *exporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for _, span := range spans {
+		e.names = append(e.names, span.Name())
+	}
+	return nil
+}
+
+func (e *exporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func (e *exporter) exported() []string {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return append([]string(nil), e.names...)
+}
+
+// The batched spans are exported by Flush and Shutdown rather than dropped
+func TestFlushShutdown(t *testing.T) {
+	e := &exporter{}
+	prev := provider
+	provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(e, sdktrace.WithBatchTimeout(time.Hour)))
+	t.Cleanup(func() { provider = prev })
+	otel.SetTracerProvider(provider)
+
+	_, span := Start(context.Background(), "run")
+	span.End()
+	assert.Empty(t, e.exported())
+	Flush()
+	assert.Equal(t, []string{"run"}, e.exported())
+
+	_, span = Start(context.Background(), "last")
+	span.End()
+	Shutdown()
+	assert.Equal(t, []string{"run", "last"}, e.exported())
+}
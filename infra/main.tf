@@ -101,6 +101,31 @@ resource "google_pubsub_topic" "errors" {
   labels = var.labels
 }
 
+resource "google_pubsub_topic" "quarantine" {
+  depends_on = [
+    google_project_iam_member.pubsub
+  ]
+
+  name                       = "quarantine-topic-pubsub-integration-golang"
+  message_retention_duration = "86400s"
+  schema_settings {
+    schema   = "projects/${data.google_project.project.project_id}/schemas/${google_pubsub_schema.event.name}"
+    encoding = "JSON"
+  }
+  labels = var.labels
+}
+
+# The undecodable events can not match the event schema, so they are published as is to the topic without schema
+resource "google_pubsub_topic" "decode_errors" {
+  depends_on = [
+    google_project_iam_member.pubsub
+  ]
+
+  name                       = "decode-errors-topic-pubsub-integration-golang"
+  message_retention_duration = "86400s"
+  labels                     = var.labels
+}
+
 resource "google_pubsub_topic" "metrics" {
   name = "metrics-topic-pubsub-integration-golang"
   schema_settings {
@@ -134,6 +159,41 @@ resource "google_pubsub_subscription" "metrics" {
   labels = var.labels
 }
 
+resource "google_pubsub_topic" "aggregate" {
+  name = "aggregate-topic-pubsub-integration-golang"
+  schema_settings {
+    schema   = "projects/${data.google_project.project.project_id}/schemas/${google_pubsub_schema.aggregate.name}"
+    encoding = "JSON"
+  }
+  labels = var.labels
+}
+
+# The aggregate metrics receives every event by its own subscription
+resource "google_pubsub_subscription" "aggregate" {
+  depends_on = [
+    google_project_iam_member.pubsub
+  ]
+
+  name  = "aggregate-subscription-pubsub-integration-golang"
+  topic = google_pubsub_topic.event.name
+  dead_letter_policy {
+    dead_letter_topic     = google_pubsub_topic.errors.id
+    max_delivery_attempts = 5
+  }
+  enable_exactly_once_delivery = true
+  labels                       = var.labels
+}
+
+resource "google_pubsub_schema" "aggregate" {
+  depends_on = [
+    module.project_services,
+  ]
+
+  name       = "aggregate-pubsub-integration-golang"
+  type       = "AVRO"
+  definition = file("${path.module}/config/avro/MetricsAggregate.avsc")
+}
+
 module "bigquery" {
   depends_on = [
     module.project_services,
@@ -24,6 +24,11 @@ output "errors_topic_name" {
   value       = google_pubsub_topic.errors.name
 }
 
+output "decode_errors_topic_name" {
+  description = "The name of the topic of the undecodable events"
+  value       = google_pubsub_topic.decode_errors.name
+}
+
 output "metrics_topic_name" {
   description = "The name of the metric topic"
   value       = google_pubsub_topic.metrics.name
@@ -39,6 +44,11 @@ output "event_subscription_name" {
   value       = google_pubsub_subscription.event.name
 }
 
+output "aggregate_subscription_name" {
+  description = "The name of the event subscription of the aggregate metrics"
+  value       = google_pubsub_subscription.aggregate.name
+}
+
 output "metrics_subscription_name" {
   description = "The name of the metrics subscription created for Pub/Sub"
   value       = google_pubsub_subscription.metrics.name
@@ -101,3 +101,40 @@ module "us_subscriber_helm" {
     ]
   )
 }
+
+module "us_aggregate_helm" {
+  depends_on = [
+    module.us_subscriber_base_helm,
+  ]
+  source = "./modules/helm"
+
+  providers = {
+    helm = helm.us_subscriber_helm
+  }
+  chart_folder_name = "aggregate"
+  region            = var.region
+  entries = concat(local.us_subscriber_base_entries,
+    [
+      {
+        name  = "project_id"
+        value = data.google_project.project.project_id
+      },
+      {
+        name  = "region"
+        value = var.region
+      },
+      {
+        name  = "image"
+        value = var.aggregate_image_url
+      },
+      {
+        name  = "config_maps.event_subscription"
+        value = google_pubsub_subscription.aggregate.name
+      },
+      {
+        name  = "config_maps.aggregate_topic"
+        value = google_pubsub_topic.aggregate.name
+      },
+    ]
+  )
+}
@@ -53,6 +53,12 @@ variable "subscriber_image_url" {
   default     = "gcr.io/aemon-projects-dev-000/jss-psi-golang-metrics-ack:latest"
 }
 
+variable "aggregate_image_url" {
+  description = "pubsub aggregate metrics app image url"
+  type        = string
+  default     = "gcr.io/aemon-projects-dev-000/jss-psi-golang-metrics-aggregate:latest"
+}
+
 variable "publisher_image_url" {
   description = "pubsub publisher app image url "
   type        = string